@@ -0,0 +1,160 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type EventType uint8
+
+const (
+	EventHandshakeAccepted EventType = iota
+	EventHandshakeRejected
+	EventReplayDetected
+	EventTimestampSkew
+	EventUnknownUser
+	EventUDPSessionCreated
+	EventUDPSessionExpired
+	EventPacketIDRejected
+	EventPacketRejected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventHandshakeAccepted:
+		return "handshake accepted"
+	case EventHandshakeRejected:
+		return "handshake rejected"
+	case EventReplayDetected:
+		return "replay detected"
+	case EventTimestampSkew:
+		return "timestamp skew"
+	case EventUnknownUser:
+		return "unknown user"
+	case EventUDPSessionCreated:
+		return "udp session created"
+	case EventUDPSessionExpired:
+		return "udp session expired"
+	case EventPacketIDRejected:
+		return "packet id rejected"
+	case EventPacketRejected:
+		return "packet rejected"
+	default:
+		return "unknown"
+	}
+}
+
+type RejectReason uint8
+
+const (
+	RejectReasonOther RejectReason = iota
+	RejectReasonBadHeader
+	RejectReasonReplay
+	RejectReasonBadTimestamp
+	RejectReasonUnknownUser
+	RejectReasonLimit
+	RejectReasonServiceClosed
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectReasonBadHeader:
+		return "bad header"
+	case RejectReasonReplay:
+		return "replay"
+	case RejectReasonBadTimestamp:
+		return "bad timestamp"
+	case RejectReasonUnknownUser:
+		return "unknown user"
+	case RejectReasonLimit:
+		return "limit"
+	case RejectReasonServiceClosed:
+		return "service closed"
+	default:
+		return "other"
+	}
+}
+
+type Event struct {
+	Type        EventType
+	Network     string
+	Method      string
+	Source      M.Socksaddr
+	Destination M.Socksaddr
+	// User is the user of multi-user services, nil if unknown or not applicable.
+	User any
+	// Reason is set for EventHandshakeRejected and EventPacketRejected.
+	Reason RejectReason
+	// SessionID and PacketID are set for shadowsocks 2022 UDP events.
+	SessionID uint64
+	PacketID  uint64
+	// TimeDiff is the difference between the client timestamp and local time for EventTimestampSkew.
+	TimeDiff time.Duration
+	// Latency is the time taken by the handshake for EventHandshakeAccepted.
+	Latency time.Duration
+	Cause   error
+}
+
+// EventHandler receives events of services, it is called synchronously and should not block.
+type EventHandler interface {
+	HandleEvent(ctx context.Context, event Event)
+}
+
+// ReportRejected reports event as EventHandshakeRejected, or EventPacketRejected for UDP,
+// preceded by an event of each of specificTypes. The reason of errors caused by
+// ErrServiceClosed is set if missing.
+func ReportRejected(ctx context.Context, handler EventHandler, event Event, specificTypes ...EventType) {
+	if event.Reason == RejectReasonOther && errors.Is(event.Cause, ErrServiceClosed) {
+		event.Reason = RejectReasonServiceClosed
+	}
+	for _, eventType := range specificTypes {
+		specificEvent := event
+		specificEvent.Type = eventType
+		handler.HandleEvent(ctx, specificEvent)
+	}
+	if event.Network == N.NetworkUDP {
+		event.Type = EventPacketRejected
+	} else {
+		event.Type = EventHandshakeRejected
+	}
+	handler.HandleEvent(ctx, event)
+}
+
+// SessionEventWriter reports EventUDPSessionCreated for event, and EventUDPSessionExpired
+// when the returned writer is closed.
+func SessionEventWriter(ctx context.Context, handler EventHandler, event Event, writer N.PacketWriter) N.PacketWriter {
+	event.Type = EventUDPSessionCreated
+	event.Network = N.NetworkUDP
+	handler.HandleEvent(ctx, event)
+	return &eventPacketWriter{PacketWriter: writer, ctx: ctx, handler: handler, event: event}
+}
+
+type eventPacketWriter struct {
+	N.PacketWriter
+	ctx     context.Context
+	handler EventHandler
+	event   Event
+	closed  uint32
+}
+
+func (w *eventPacketWriter) Close() error {
+	if atomic.CompareAndSwapUint32(&w.closed, 0, 1) {
+		event := w.event
+		event.Type = EventUDPSessionExpired
+		w.handler.HandleEvent(w.ctx, event)
+	}
+	if closer, isCloser := w.PacketWriter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (w *eventPacketWriter) Upstream() any {
+	return w.PacketWriter
+}
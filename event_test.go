@@ -0,0 +1,32 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common"
+)
+
+func TestSessionEventWriterClose(t *testing.T) {
+	t.Parallel()
+	handler := &eventCounter{}
+	writer := shadowsocks.SessionEventWriter(context.Background(), handler, shadowsocks.Event{}, nil)
+	for i := 0; i < 3; i++ {
+		common.Close(writer)
+	}
+	if handler.events[shadowsocks.EventUDPSessionCreated] != 1 || handler.events[shadowsocks.EventUDPSessionExpired] != 1 {
+		t.Fatal("expected one created and one expired event, got ", handler.events)
+	}
+}
+
+type eventCounter struct {
+	events map[shadowsocks.EventType]int
+}
+
+func (h *eventCounter) HandleEvent(ctx context.Context, event shadowsocks.Event) {
+	if h.events == nil {
+		h.events = make(map[shadowsocks.EventType]int)
+	}
+	h.events[event.Type]++
+}
@@ -0,0 +1,141 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	// MaxRecordedHandshake is the maximum number of handshake bytes recorded for a FailurePolicy.
+	MaxRecordedHandshake = 64 * 1024
+	// DefaultDrainTimeout bounds DrainPolicy and RandomTimeoutPolicy without a timeout.
+	DefaultDrainTimeout = time.Minute
+)
+
+// FailurePolicy decides what happens to a connection after a failed handshake.
+// header contains the bytes read from conn before the failure, it may be truncated
+// to MaxRecordedHandshake bytes.
+type FailurePolicy interface {
+	HandleFailure(ctx context.Context, conn net.Conn, header []byte, metadata M.Metadata, cause error) error
+}
+
+// ServeConnection calls serve on a connection that records the handshake, and applies
+// policy if serve fails before HandshakeSuccess is called.
+// A nil policy keeps the default behavior of resetting the connection.
+func ServeConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, policy FailurePolicy, serve func(ctx context.Context, conn net.Conn, metadata M.Metadata) error) error {
+	recorder := &recordConn{Conn: conn, record: policy != nil, start: time.Now()}
+	err := serve(ctx, recorder, metadata)
+	if err == nil {
+		return nil
+	}
+	if recorder.finished {
+		return &ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	recorder.finished = true
+	if policy == nil {
+		return &ServerConnError{Conn: conn, Source: metadata.Source, Cause: err, Handshake: true}
+	}
+	policyErr := policy.HandleFailure(ctx, conn, recorder.header, metadata, err)
+	if policyErr != nil {
+		err = E.Errors(err, E.Cause(policyErr, "failure policy"))
+	}
+	return &ServerConnError{Conn: conn, Source: metadata.Source, Cause: err, Handshake: true, Handled: true}
+}
+
+// IsHandshakeError returns whether err is returned by ServeConnection for a failed handshake.
+func IsHandshakeError(err error) bool {
+	var connErr *ServerConnError
+	return errors.As(err, &connErr) && connErr.Handshake
+}
+
+// HandshakeSuccess stops recording on a connection passed in by ServeConnection,
+// and returns the time elapsed since ServeConnection was called.
+func HandshakeSuccess(conn net.Conn) time.Duration {
+	if recorder, isRecorder := conn.(*recordConn); isRecorder {
+		recorder.finished = true
+		recorder.header = nil
+		return time.Since(recorder.start)
+	}
+	return 0
+}
+
+type recordConn struct {
+	net.Conn
+	header   []byte
+	record   bool
+	finished bool
+	start    time.Time
+}
+
+func (c *recordConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if c.record && !c.finished && n > 0 {
+		record := n
+		if free := MaxRecordedHandshake - len(c.header); record > free {
+			record = free
+		}
+		c.header = append(c.header, p[:record]...)
+	}
+	return
+}
+
+func (c *recordConn) Upstream() any {
+	return c.Conn
+}
+
+// DrainPolicy reads and discards until the peer closes the connection or Timeout
+// elapses, then closes it normally. A zero Timeout uses DefaultDrainTimeout.
+type DrainPolicy struct {
+	Timeout time.Duration
+}
+
+func (p *DrainPolicy) HandleFailure(ctx context.Context, conn net.Conn, header []byte, metadata M.Metadata, cause error) error {
+	return drain(conn, p.Timeout)
+}
+
+// RandomTimeoutPolicy behaves like DrainPolicy with a timeout picked in [MinTimeout, MaxTimeout].
+// A zero timeout uses DefaultDrainTimeout.
+type RandomTimeoutPolicy struct {
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+}
+
+func (p *RandomTimeoutPolicy) HandleFailure(ctx context.Context, conn net.Conn, header []byte, metadata M.Metadata, cause error) error {
+	timeout := p.MinTimeout
+	if p.MaxTimeout > p.MinTimeout {
+		timeout += time.Duration(rand.Int63n(int64(p.MaxTimeout - p.MinTimeout)))
+	}
+	return drain(conn, timeout)
+}
+
+func drain(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	return nil
+}
+
+// FallbackPolicy hands the connection to Handler, replaying the bytes already read.
+type FallbackPolicy struct {
+	Handler N.TCPConnectionHandler
+}
+
+func (p *FallbackPolicy) HandleFailure(ctx context.Context, conn net.Conn, header []byte, metadata M.Metadata, cause error) error {
+	if len(header) > 0 {
+		conn = bufio.NewCachedConn(conn, buf.As(header))
+	}
+	return p.Handler.NewConnection(ctx, conn, metadata)
+}
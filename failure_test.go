@@ -0,0 +1,94 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestFallbackPolicy(t *testing.T) {
+	t.Parallel()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go clientConn.Write([]byte("GET / HTTP/1.1\r\n"))
+
+	badHandshake := errors.New("bad handshake")
+	fallback := &fallbackHandler{}
+	err := shadowsocks.ServeConnection(context.Background(), serverConn, M.Metadata{}, &shadowsocks.FallbackPolicy{Handler: fallback}, func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		if err != nil {
+			return err
+		}
+		return badHandshake
+	})
+	var connErr *shadowsocks.ServerConnError
+	if !errors.As(err, &connErr) || !connErr.Handled || !errors.Is(err, badHandshake) {
+		t.Fatal("unexpected error: ", err)
+	}
+	if fallback.request != "GET / HTTP/1.1\r\n" {
+		t.Fatal("bad fallback request: ", fallback.request)
+	}
+}
+
+func TestFailurePolicySkippedAfterHandshake(t *testing.T) {
+	t.Parallel()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	handlerErr := errors.New("dial failed")
+	fallback := &fallbackHandler{}
+	err := shadowsocks.ServeConnection(context.Background(), serverConn, M.Metadata{}, &shadowsocks.FallbackPolicy{Handler: fallback}, func(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+		shadowsocks.HandshakeSuccess(conn)
+		return handlerErr
+	})
+	var connErr *shadowsocks.ServerConnError
+	if !errors.As(err, &connErr) || connErr.Handled || fallback.called {
+		t.Fatal("failure policy applied after handshake")
+	}
+}
+
+func TestDrainPolicyDefaultTimeout(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []shadowsocks.FailurePolicy{&shadowsocks.DrainPolicy{}, &shadowsocks.RandomTimeoutPolicy{}} {
+		serverConn, clientConn := net.Pipe()
+		conn := &deadlineConn{Conn: serverConn}
+		go clientConn.Close()
+		start := time.Now()
+		err := policy.HandleFailure(context.Background(), conn, nil, M.Metadata{}, errors.New("bad handshake"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.deadline.Before(start.Add(shadowsocks.DefaultDrainTimeout)) || conn.deadline.After(time.Now().Add(shadowsocks.DefaultDrainTimeout)) {
+			t.Fatal("expected default drain timeout, got deadline ", conn.deadline.Sub(start))
+		}
+	}
+}
+
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+type fallbackHandler struct {
+	called  bool
+	request string
+}
+
+func (h *fallbackHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.called = true
+	request := make([]byte, 16)
+	_, err := io.ReadFull(conn, request)
+	h.request = string(request)
+	return err
+}
@@ -0,0 +1,206 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sagernet/sing-shadowsocks/shadowmux"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// MuxClient carries streams over a few connections of method, so only the first stream
+// of each connection pays for the TCP and shadowsocks handshakes. Sessions use the
+// sing-mux protocol with smux and without padding.
+type MuxClient struct {
+	method     Method
+	dial       func(ctx context.Context) (net.Conn, error)
+	maxStreams int
+
+	access   sync.Mutex
+	sessions []*shadowmux.Session
+}
+
+// NewMuxClient creates a client connecting to the server with dial. A new connection is
+// opened when every existing one carries maxStreams streams, zero means no limit.
+func NewMuxClient(method Method, dial func(ctx context.Context) (net.Conn, error), maxStreams int) *MuxClient {
+	return &MuxClient{
+		method:     method,
+		dial:       dial,
+		maxStreams: maxStreams,
+	}
+}
+
+// DialContext opens a stream to destination.
+func (c *MuxClient) DialContext(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	session, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	err = shadowmux.WriteStreamRequest(stream, destination)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return shadowmux.NewClientConn(stream), nil
+}
+
+func (c *MuxClient) session(ctx context.Context) (*shadowmux.Session, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	sessions := c.sessions[:0]
+	for _, session := range c.sessions {
+		if !session.IsClosed() {
+			sessions = append(sessions, session)
+		}
+	}
+	c.sessions = sessions
+	for _, session := range sessions {
+		if c.maxStreams <= 0 || session.NumStreams() < c.maxStreams {
+			return session, nil
+		}
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session, err := shadowmux.NewClient(c.method.DialEarlyConn(conn, shadowmux.Destination))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.sessions = append(c.sessions, session)
+	return session, nil
+}
+
+// Close closes all connections and their streams.
+func (c *MuxClient) Close() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	for _, session := range c.sessions {
+		session.Close()
+	}
+	c.sessions = nil
+	return nil
+}
+
+// MuxOptions configures how a service serves the streams of mux sessions.
+type MuxOptions struct {
+	// Registry tracks each stream as a connection of User if set.
+	Registry *Registry
+	User     any
+	// Shutdown rejects new streams once the service is shut down,
+	// the session ends when its remaining streams are done.
+	Shutdown *ShutdownGroup
+	// AcquireStream is called before a stream is passed to the handler, an error rejects
+	// the stream, otherwise release is called when the stream is done.
+	AcquireStream func() (release func(), err error)
+}
+
+// IsMuxDestination returns whether a connection to destination carries a mux session.
+func IsMuxDestination(destination M.Socksaddr) bool {
+	return destination.Fqdn == shadowmux.MagicAddress
+}
+
+// HandleMuxConnection is HandleConnection for services serving mux sessions, a mux session
+// on conn is unwrapped into its streams, each passed to handler with the destination it requests.
+func HandleMuxConnection(ctx context.Context, handler Handler, conn net.Conn, metadata M.Metadata, options MuxOptions) error {
+	if !IsMuxDestination(metadata.Destination) {
+		return HandleConnection(ctx, handler, conn, metadata)
+	}
+	session, err := shadowmux.NewServer(conn)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	var (
+		access  sync.Mutex
+		active  int
+		closing bool
+		group   sync.WaitGroup
+	)
+	defer group.Wait()
+	if options.Shutdown != nil {
+		go func() {
+			select {
+			case <-options.Shutdown.Closing():
+			case <-session.Done():
+				return
+			}
+			access.Lock()
+			closing = true
+			if active == 0 {
+				session.Close()
+			}
+			access.Unlock()
+		}()
+	}
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if E.IsClosed(err) || errors.Is(err, shadowmux.ErrSessionClosed) {
+				return nil
+			}
+			return err
+		}
+		access.Lock()
+		if closing {
+			access.Unlock()
+			shadowmux.RejectStream(stream, ErrServiceClosed)
+			stream.Close()
+			continue
+		}
+		active++
+		access.Unlock()
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			newMuxStream(ctx, handler, stream, metadata, options)
+			stream.Close()
+			access.Lock()
+			active--
+			if closing && active == 0 {
+				session.Close()
+			}
+			access.Unlock()
+		}()
+	}
+}
+
+func newMuxStream(ctx context.Context, handler Handler, stream net.Conn, metadata M.Metadata, options MuxOptions) {
+	destination, err := shadowmux.ReadStreamRequest(stream)
+	if err == nil && IsMuxDestination(destination) {
+		err = E.New("nested mux stream")
+	}
+	if err == nil && options.AcquireStream != nil {
+		var release func()
+		release, err = options.AcquireStream()
+		if release != nil {
+			defer release()
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			shadowmux.RejectStream(stream, err)
+		}
+		handler.NewError(ctx, err)
+		return
+	}
+	metadata.Destination = destination
+	var conn net.Conn = shadowmux.NewServerConn(stream)
+	if options.Registry != nil {
+		conn = options.Registry.TrackConn(conn, metadata, options.User)
+		defer options.Registry.Untrack(conn)
+	}
+	err = HandleConnection(ctx, handler, conn, metadata)
+	if err != nil {
+		handler.NewError(ctx, err)
+	}
+}
@@ -0,0 +1,141 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowmux"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestMux(t *testing.T) {
+	t.Parallel()
+	service := shadowsocks.NewNoneService(500, &muxHandler{t})
+	service.SetMux(true)
+	var dials int
+	client := shadowsocks.NewMuxClient(shadowsocks.NewNone(), func(ctx context.Context) (net.Conn, error) {
+		dials++
+		serverConn, clientConn := net.Pipe()
+		go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		return clientConn, nil
+	}, 2)
+	defer client.Close()
+
+	destinations := []string{"1.1.1.1:80", "example.com:443", "[::1]:8080"}
+	streams := make([]net.Conn, 0, len(destinations))
+	for _, destination := range destinations {
+		stream, err := client.DialContext(context.Background(), M.ParseSocksaddr(destination))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		streams = append(streams, stream)
+	}
+	for i, stream := range streams {
+		response, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(response) != destinations[i] {
+			t.Fatal("stream ", i, ": expected ", destinations[i], ", got ", string(response))
+		}
+	}
+	if dials != 2 {
+		t.Fatal("expected 2 connections, got ", dials)
+	}
+}
+
+func TestMuxShutdown(t *testing.T) {
+	t.Parallel()
+	handler := &muxBlockHandler{started: make(chan M.Socksaddr, 1), release: make(chan struct{})}
+	service := shadowsocks.NewNoneService(500, handler)
+	service.SetMux(true)
+	registry := shadowsocks.NewRegistry()
+	service.SetRegistry(registry)
+	client := shadowsocks.NewMuxClient(shadowsocks.NewNone(), func(ctx context.Context) (net.Conn, error) {
+		serverConn, clientConn := net.Pipe()
+		go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		return clientConn, nil
+	}, 0)
+	defer client.Close()
+
+	stream, err := client.DialContext(context.Background(), M.ParseSocksaddr("example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handler.started
+	// the session and its stream
+	var streamTracked bool
+	for _, connection := range registry.Connections() {
+		streamTracked = streamTracked || connection.Destination.String() == "example.com:443"
+	}
+	if len(registry.Connections()) != 2 || !streamTracked {
+		t.Fatal("stream not tracked: ", registry.Connections())
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		_, err := service.Shutdown(context.Background())
+		shutdownDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	rejected, err := client.DialContext(context.Background(), M.ParseSocksaddr("example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rejected.Read(make([]byte, 1))
+	var remoteErr *shadowmux.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatal("expected stream rejected after shutdown, got ", err)
+	}
+
+	// the session ends with its last stream
+	close(handler.release)
+	err = <-shutdownDone
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+type muxBlockHandler struct {
+	started chan M.Socksaddr
+	release chan struct{}
+}
+
+func (h *muxBlockHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.started <- metadata.Destination
+	<-h.release
+	return nil
+}
+
+func (h *muxBlockHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *muxBlockHandler) NewError(ctx context.Context, err error) {
+}
+
+type muxHandler struct {
+	t *testing.T
+}
+
+func (h *muxHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := conn.Write([]byte(metadata.Destination.String()))
+	return err
+}
+
+func (h *muxHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.t.Error("unexpected packet connection")
+	return nil
+}
+
+func (h *muxHandler) NewError(ctx context.Context, err error) {
+	h.t.Error(err)
+}
@@ -181,12 +181,18 @@ func (c *nonePacketConn) Headroom() int {
 	return M.MaxSocksaddrLength
 }
 
+var _ ShutdownService = (*NoneService)(nil)
+
 type NoneService struct {
-	handler Handler
-	udpNat  *udpnat.Service[netip.AddrPort]
+	handler  Handler
+	udpNat   *udpnat.Service[netip.AddrPort]
+	registry *Registry
+	events   EventHandler
+	shutdown ShutdownGroup
+	mux      bool
 }
 
-func NewNoneService(udpTimeout int64, handler Handler) Service {
+func NewNoneService(udpTimeout int64, handler Handler) *NoneService {
 	s := &NoneService{
 		handler: handler,
 	}
@@ -194,6 +200,21 @@ func NewNoneService(udpTimeout int64, handler Handler) Service {
 	return s
 }
 
+// SetRegistry enables tracking of live connections and UDP sessions, nil disables it.
+func (s *NoneService) SetRegistry(registry *Registry) {
+	s.registry = registry
+}
+
+// SetEventHandler sets the handler of structured events, nil disables them.
+func (s *NoneService) SetEventHandler(handler EventHandler) {
+	s.events = handler
+}
+
+// SetMux enables serving mux sessions, each stream is tracked as a connection.
+func (s *NoneService) SetMux(enabled bool) {
+	s.mux = enabled
+}
+
 func (s *NoneService) Name() string {
 	return MethodNone
 }
@@ -203,31 +224,81 @@ func (s *NoneService) Password() string {
 }
 
 func (s *NoneService) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if !s.shutdown.AcquireConn(conn) {
+		s.reportError(ctx, N.NetworkTCP, metadata, ErrServiceClosed)
+		return ErrServiceClosed
+	}
+	defer s.shutdown.ReleaseConn(conn)
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(conn)
 	if err != nil {
+		s.reportError(ctx, N.NetworkTCP, metadata, err)
 		return err
 	}
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	return s.handler.NewConnection(ctx, conn, metadata)
+	if s.events != nil {
+		s.events.HandleEvent(ctx, Event{Type: EventHandshakeAccepted, Network: N.NetworkTCP, Method: MethodNone, Source: metadata.Source, Destination: destination})
+	}
+	if s.registry != nil {
+		conn = s.registry.TrackConn(conn, metadata, nil)
+		defer s.registry.Untrack(conn)
+	}
+	if s.mux {
+		return HandleMuxConnection(ctx, s.handler, conn, metadata, MuxOptions{Registry: s.registry, Shutdown: &s.shutdown})
+	}
+	return HandleConnection(ctx, s.handler, conn, metadata)
+}
+
+// Shutdown stops accepting new connections and packets, see ShutdownGroup.
+func (s *NoneService) Shutdown(ctx context.Context) (int, error) {
+	return s.shutdown.Shutdown(ctx)
 }
 
 func (s *NoneService) WriteIsThreadUnsafe() {
 }
 
 func (s *NoneService) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	if !s.shutdown.AcquirePacket() {
+		s.reportError(ctx, N.NetworkUDP, metadata, ErrServiceClosed)
+		return ErrServiceClosed
+	}
+	defer s.shutdown.ReleasePacket()
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
+		s.reportError(ctx, N.NetworkUDP, metadata, err)
 		return err
 	}
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	s.udpNat.NewPacket(ctx, metadata.Source.AddrPort(), buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
-		return &nonePacketWriter{conn, natConn}
+	source := metadata.Source.AddrPort()
+	packetLen := buffer.Len()
+	s.udpNat.NewPacket(ctx, source, buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
+		var writer N.PacketWriter = &nonePacketWriter{conn, natConn}
+		if s.registry != nil {
+			writer = s.registry.TrackPacketWriter(s, source, 0, natConn, writer, metadata, nil)
+		}
+		if s.events != nil {
+			writer = SessionEventWriter(ctx, s.events, Event{Method: MethodNone, Source: metadata.Source, Destination: destination}, writer)
+		}
+		return s.shutdown.TrackPacketWriter(natConn, writer)
 	})
+	if s.registry != nil {
+		s.registry.TrackPacket(s, source, packetLen)
+	}
 	return nil
 }
 
+func (s *NoneService) reportError(ctx context.Context, network string, metadata M.Metadata, err error) {
+	if s.events == nil {
+		return
+	}
+	event := Event{Network: network, Method: MethodNone, Source: metadata.Source, Cause: err}
+	if err != ErrServiceClosed {
+		event.Reason = RejectReasonBadHeader
+	}
+	ReportRejected(ctx, s.events, event)
+}
+
 type nonePacketWriter struct {
 	source N.PacketConn
 	nat    N.PacketConn
@@ -0,0 +1,239 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	DefaultPoolIdleTimeout = 30 * time.Second
+	poolCheckInterval      = 5 * time.Second
+	poolMinBackoff         = time.Second
+	poolMaxBackoff         = time.Minute
+)
+
+var ErrPoolClosed = E.New("pool closed")
+
+// Pool keeps up to size TCP connections to the server open in advance, so requests skip
+// the TCP handshake. Each connection carries a single shadowsocks connection with its own
+// salt and session keys and is never returned to the pool.
+type Pool struct {
+	method      Method
+	dial        func(ctx context.Context) (net.Conn, error)
+	size        int
+	idleTimeout time.Duration
+
+	access sync.Mutex
+	idle   []poolConn
+	closed bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	refill chan struct{}
+	done   chan struct{}
+
+	// accessed by loop only
+	backoff time.Duration
+	retryAt time.Time
+}
+
+type poolConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// NewPool creates a pool connecting to the server with dial. Idle connections are closed
+// after idleTimeout, or DefaultPoolIdleTimeout if zero, and are checked periodically for
+// being closed by the server. Failed dials of the pool are retried with exponential backoff.
+func NewPool(method Method, dial func(ctx context.Context) (net.Conn, error), size int, idleTimeout time.Duration) *Pool {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultPoolIdleTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		method:      method,
+		dial:        dial,
+		size:        size,
+		idleTimeout: idleTimeout,
+		ctx:         ctx,
+		cancel:      cancel,
+		refill:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+// DialEarlyConn returns a shadowsocks connection to destination on a pooled connection,
+// or on a new one if none is available. The handshake is sent with the first write.
+func (p *Pool) DialEarlyConn(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	conn := p.take()
+	if conn == nil {
+		p.access.Lock()
+		closed := p.closed
+		p.access.Unlock()
+		if closed {
+			return nil, ErrPoolClosed
+		}
+		var err error
+		conn, err = p.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+	return p.method.DialEarlyConn(conn, destination), nil
+}
+
+// Idle returns the number of connections in the pool.
+func (p *Pool) Idle() int {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return len(p.idle)
+}
+
+// Close closes all idle connections, connections already handed out are not affected.
+func (p *Pool) Close() error {
+	p.access.Lock()
+	if p.closed {
+		p.access.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.access.Unlock()
+	p.cancel()
+	<-p.done
+	p.access.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.access.Unlock()
+	for _, pooled := range idle {
+		pooled.conn.Close()
+	}
+	return nil
+}
+
+func (p *Pool) take() net.Conn {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for len(p.idle) > 0 {
+		// the newest connection is the least likely to be closed by the server
+		newest := 0
+		for i, pooled := range p.idle {
+			if pooled.created.After(p.idle[newest].created) {
+				newest = i
+			}
+		}
+		pooled := p.idle[newest]
+		p.idle = append(p.idle[:newest], p.idle[newest+1:]...)
+		if time.Since(pooled.created) < p.idleTimeout {
+			return pooled.conn
+		}
+		pooled.conn.Close()
+	}
+	return nil
+}
+
+func (p *Pool) loop() {
+	defer close(p.done)
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.check()
+		p.fill()
+		select {
+		case <-p.refill:
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// check closes idle connections that expired or were closed by the server,
+// connections are taken out of the pool one at a time while being checked.
+func (p *Pool) check() {
+	p.access.Lock()
+	count := len(p.idle)
+	p.access.Unlock()
+	for i := 0; i < count; i++ {
+		p.access.Lock()
+		if len(p.idle) == 0 {
+			p.access.Unlock()
+			return
+		}
+		pooled := p.idle[0]
+		p.idle = p.idle[1:]
+		p.access.Unlock()
+		if time.Since(pooled.created) < p.idleTimeout && isConnAlive(pooled.conn) {
+			p.access.Lock()
+			p.idle = append(p.idle, pooled)
+			p.access.Unlock()
+		} else {
+			pooled.conn.Close()
+		}
+	}
+}
+
+func (p *Pool) fill() {
+	if time.Now().Before(p.retryAt) {
+		return
+	}
+	for {
+		p.access.Lock()
+		full := p.closed || len(p.idle) >= p.size
+		p.access.Unlock()
+		if full {
+			return
+		}
+		conn, err := p.dial(p.ctx)
+		if err != nil {
+			if p.backoff == 0 {
+				p.backoff = poolMinBackoff
+			} else if p.backoff < poolMaxBackoff {
+				p.backoff *= 2
+				if p.backoff > poolMaxBackoff {
+					p.backoff = poolMaxBackoff
+				}
+			}
+			p.retryAt = time.Now().Add(p.backoff)
+			return
+		}
+		p.backoff = 0
+		p.access.Lock()
+		if p.closed {
+			p.access.Unlock()
+			conn.Close()
+			return
+		}
+		p.idle = append(p.idle, poolConn{conn, time.Now()})
+		p.access.Unlock()
+	}
+}
+
+// isConnAlive reports whether conn is still open, the server never sends data before
+// the handshake, so a read that times out means the connection is alive. Connections
+// without read deadlines can not be checked and are kept until they expire.
+func isConnAlive(conn net.Conn) bool {
+	err := conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	if err != nil {
+		return !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe)
+	}
+	var buffer [1]byte
+	_, err = conn.Read(buffer[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
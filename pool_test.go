@@ -0,0 +1,237 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestPool(t *testing.T) {
+	t.Parallel()
+	service := shadowsocks.NewNoneService(500, &poolHandler{t})
+	var access sync.Mutex
+	var serverConns []net.Conn
+	pool := shadowsocks.NewPool(shadowsocks.NewNone(), func(ctx context.Context) (net.Conn, error) {
+		serverConn, clientConn := net.Pipe()
+		access.Lock()
+		serverConns = append(serverConns, serverConn)
+		access.Unlock()
+		return clientConn, nil
+	}, 2, 0)
+	defer pool.Close()
+
+	for i := 0; pool.Idle() < 2; i++ {
+		if i == 100 {
+			t.Fatal("pool not filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	access.Lock()
+	for _, serverConn := range serverConns {
+		go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	}
+	access.Unlock()
+
+	conn, err := pool.DialEarlyConn(context.Background(), M.ParseSocksaddr("example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, len("example.com:443"))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "example.com:443" {
+		t.Fatal("bad response ", string(response))
+	}
+	conn.Close()
+}
+
+func TestPoolIdleExpiry(t *testing.T) {
+	t.Parallel()
+	dialer := &poolDialer{}
+	pool := shadowsocks.NewPool(shadowsocks.NewNone(), dialer.dial, 1, 50*time.Millisecond)
+	defer pool.Close()
+	waitPoolIdle(t, pool, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	conn, err := pool.DialEarlyConn(context.Background(), M.ParseSocksaddr("example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the expired connection is closed instead of being used
+	if !isPipeClosed(dialer.serverConn(0)) {
+		t.Fatal("expired connection not closed")
+	}
+	if dialer.count() < 2 {
+		t.Fatal("expected a new connection")
+	}
+}
+
+func TestPoolEviction(t *testing.T) {
+	t.Parallel()
+	dialer := &poolDialer{}
+	pool := shadowsocks.NewPool(shadowsocks.NewNone(), dialer.dial, 2, 0)
+	defer pool.Close()
+	waitPoolIdle(t, pool, 2)
+
+	// the oldest connection is closed by the server, the newest one is taken
+	dialer.serverConn(0).Close()
+	conn, err := pool.DialEarlyConn(context.Background(), M.ParseSocksaddr("example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; dialer.count() < 4; i++ {
+		if i == 1000 {
+			t.Fatal("closed connection not replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waitPoolIdle(t, pool, 2)
+}
+
+func TestPoolNoDeadline(t *testing.T) {
+	t.Parallel()
+	dialer := &poolDialer{noDeadline: true}
+	pool := shadowsocks.NewPool(shadowsocks.NewNone(), dialer.dial, 2, 0)
+	defer pool.Close()
+	waitPoolIdle(t, pool, 2)
+
+	conn, err := pool.DialEarlyConn(context.Background(), M.ParseSocksaddr("example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitPoolIdle(t, pool, 2)
+	time.Sleep(50 * time.Millisecond)
+	// the connection that can not be checked is kept
+	if count := dialer.count(); count != 3 {
+		t.Fatal("expected 3 connections, got ", count)
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	t.Parallel()
+	var access sync.Mutex
+	var poolDials int
+	pool := shadowsocks.NewPool(shadowsocks.NewNone(), func(ctx context.Context) (net.Conn, error) {
+		if ctx.Value(poolDirectDial{}) != nil {
+			_, clientConn := net.Pipe()
+			return clientConn, nil
+		}
+		access.Lock()
+		poolDials++
+		access.Unlock()
+		return nil, io.ErrUnexpectedEOF
+	}, 1, 0)
+	defer pool.Close()
+
+	// the server refuses the connections of the pool while requests are dialed directly
+	ctx := context.WithValue(context.Background(), poolDirectDial{}, true)
+	for i := 0; i < 20; i++ {
+		conn, err := pool.DialEarlyConn(ctx, M.ParseSocksaddr("example.com:443"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		time.Sleep(5 * time.Millisecond)
+	}
+	access.Lock()
+	defer access.Unlock()
+	if poolDials > 2 {
+		t.Fatal("expected failed dials to back off, got ", poolDials, " dials")
+	}
+}
+
+type poolDirectDial struct{}
+
+type poolDialer struct {
+	access      sync.Mutex
+	serverConns []net.Conn
+	noDeadline  bool
+}
+
+func (d *poolDialer) dial(ctx context.Context) (net.Conn, error) {
+	// keep creation times distinct, the newest connection is taken first
+	time.Sleep(2 * time.Millisecond)
+	serverConn, clientConn := net.Pipe()
+	d.access.Lock()
+	d.serverConns = append(d.serverConns, serverConn)
+	d.access.Unlock()
+	if d.noDeadline {
+		return &noDeadlineConn{clientConn}, nil
+	}
+	return clientConn, nil
+}
+
+func (d *poolDialer) count() int {
+	d.access.Lock()
+	defer d.access.Unlock()
+	return len(d.serverConns)
+}
+
+func (d *poolDialer) serverConn(index int) net.Conn {
+	d.access.Lock()
+	defer d.access.Unlock()
+	return d.serverConns[index]
+}
+
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (c *noDeadlineConn) SetReadDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+func waitPoolIdle(t *testing.T, pool *shadowsocks.Pool, idle int) {
+	for i := 0; pool.Idle() < idle; i++ {
+		if i == 1000 {
+			t.Fatal("pool not filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// isPipeClosed reports whether the other side of a pipe is closed.
+func isPipeClosed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+type poolHandler struct {
+	t *testing.T
+}
+
+func (h *poolHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := io.ReadFull(conn, make([]byte, len("hello")))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(metadata.Destination.String()))
+	return err
+}
+
+func (h *poolHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.t.Error("unexpected packet connection")
+	return nil
+}
+
+func (h *poolHandler) NewError(ctx context.Context, err error) {
+	h.t.Error(err)
+}
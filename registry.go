@@ -0,0 +1,287 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type ConnectionInfo struct {
+	ID          uint64
+	Source      M.Socksaddr
+	Destination M.Socksaddr
+	User        any
+	Start       time.Time
+	Upload      uint64
+	Download    uint64
+}
+
+type SessionInfo struct {
+	ID uint64
+	// SessionID is the client session id of shadowsocks 2022 methods, zero for other methods.
+	SessionID       uint64
+	Source          M.Socksaddr
+	Destination     M.Socksaddr
+	User            any
+	Start           time.Time
+	LastSeen        time.Time
+	UploadPackets   uint64
+	UploadBytes     uint64
+	DownloadPackets uint64
+	DownloadBytes   uint64
+}
+
+// Registry tracks live connections and UDP sessions of services for inspection and
+// force closing. A registry can be shared by multiple services.
+type Registry struct {
+	access      sync.Mutex
+	nextID      uint64
+	connections map[uint64]*registryConn
+	sessions    map[registryKey]*registrySession
+}
+
+type registryKey struct {
+	owner any
+	key   any
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		connections: make(map[uint64]*registryConn),
+		sessions:    make(map[registryKey]*registrySession),
+	}
+}
+
+func (r *Registry) Connections() []ConnectionInfo {
+	r.access.Lock()
+	defer r.access.Unlock()
+	connections := make([]ConnectionInfo, 0, len(r.connections))
+	for _, conn := range r.connections {
+		connections = append(connections, ConnectionInfo{
+			ID:          conn.id,
+			Source:      conn.source,
+			Destination: conn.destination,
+			User:        conn.user,
+			Start:       conn.start,
+			Upload:      atomic.LoadUint64(&conn.upload),
+			Download:    atomic.LoadUint64(&conn.download),
+		})
+	}
+	return connections
+}
+
+func (r *Registry) Sessions() []SessionInfo {
+	r.access.Lock()
+	defer r.access.Unlock()
+	sessions := make([]SessionInfo, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, SessionInfo{
+			ID:              session.id,
+			SessionID:       session.sessionId,
+			Source:          session.source,
+			Destination:     session.destination,
+			User:            session.user,
+			Start:           session.start,
+			LastSeen:        time.Unix(0, atomic.LoadInt64(&session.lastSeen)),
+			UploadPackets:   atomic.LoadUint64(&session.uploadPackets),
+			UploadBytes:     atomic.LoadUint64(&session.uploadBytes),
+			DownloadPackets: atomic.LoadUint64(&session.downloadPackets),
+			DownloadBytes:   atomic.LoadUint64(&session.downloadBytes),
+		})
+	}
+	return sessions
+}
+
+// CloseConnection closes the connection or UDP session with the registry id.
+func (r *Registry) CloseConnection(id uint64) bool {
+	return r.closeMatched(func(entryID uint64, source M.Socksaddr, user any) bool {
+		return entryID == id
+	}) > 0
+}
+
+// CloseUser closes all connections and UDP sessions of the user.
+func (r *Registry) CloseUser(user any) int {
+	return r.closeMatched(func(entryID uint64, source M.Socksaddr, entryUser any) bool {
+		return entryUser == user
+	})
+}
+
+// CloseSource closes all connections and UDP sessions from the address.
+func (r *Registry) CloseSource(addr netip.Addr) int {
+	addr = addr.Unmap()
+	return r.closeMatched(func(entryID uint64, source M.Socksaddr, user any) bool {
+		return source.Addr.Unmap() == addr
+	})
+}
+
+func (r *Registry) closeMatched(match func(id uint64, source M.Socksaddr, user any) bool) int {
+	var closers []io.Closer
+	r.access.Lock()
+	for _, conn := range r.connections {
+		if match(conn.id, conn.source, conn.user) {
+			closers = append(closers, conn)
+		}
+	}
+	for _, session := range r.sessions {
+		if match(session.id, session.source, session.user) {
+			closers = append(closers, session.natConn)
+		}
+	}
+	r.access.Unlock()
+	for _, closer := range closers {
+		closer.Close()
+	}
+	return len(closers)
+}
+
+// TrackConn registers the connection until it is closed or Untrack is called.
+func (r *Registry) TrackConn(conn net.Conn, metadata M.Metadata, user any) net.Conn {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.nextID++
+	registryConn := &registryConn{
+		Conn:        conn,
+		registry:    r,
+		id:          r.nextID,
+		source:      metadata.Source,
+		destination: metadata.Destination,
+		user:        user,
+		start:       time.Now(),
+	}
+	r.connections[registryConn.id] = registryConn
+	return registryConn
+}
+
+func (r *Registry) Untrack(conn net.Conn) {
+	if registryConn, isRegistryConn := conn.(*registryConn); isRegistryConn {
+		r.access.Lock()
+		delete(r.connections, registryConn.id)
+		r.access.Unlock()
+	}
+}
+
+// TrackPacket counts a packet received for the UDP session identified by owner and key.
+func (r *Registry) TrackPacket(owner any, key any, n int) {
+	r.access.Lock()
+	session, loaded := r.sessions[registryKey{owner, key}]
+	r.access.Unlock()
+	if loaded {
+		atomic.AddUint64(&session.uploadPackets, 1)
+		atomic.AddUint64(&session.uploadBytes, uint64(n))
+		atomic.StoreInt64(&session.lastSeen, time.Now().UnixNano())
+	}
+}
+
+// TrackPacketWriter registers the UDP session identified by owner and key until the writer is closed,
+// natConn is closed to force close the session.
+func (r *Registry) TrackPacketWriter(owner any, key any, sessionId uint64, natConn io.Closer, writer N.PacketWriter, metadata M.Metadata, user any) N.PacketWriter {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.nextID++
+	now := time.Now()
+	session := &registrySession{
+		PacketWriter: writer,
+		registry:     r,
+		key:          registryKey{owner, key},
+		natConn:      natConn,
+		id:           r.nextID,
+		sessionId:    sessionId,
+		source:       metadata.Source,
+		destination:  metadata.Destination,
+		user:         user,
+		start:        now,
+		lastSeen:     now.UnixNano(),
+	}
+	r.sessions[session.key] = session
+	return session
+}
+
+type registryConn struct {
+	upload      uint64
+	download    uint64
+	registry    *Registry
+	id          uint64
+	source      M.Socksaddr
+	destination M.Socksaddr
+	user        any
+	start       time.Time
+	net.Conn
+}
+
+func (c *registryConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddUint64(&c.upload, uint64(n))
+	return
+}
+
+func (c *registryConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddUint64(&c.download, uint64(n))
+	return
+}
+
+func (c *registryConn) WriteTo(w io.Writer) (n int64, err error) {
+	return bufio.Copy(&countWriter{w, &c.upload}, c.Conn)
+}
+
+func (c *registryConn) ReadFrom(r io.Reader) (n int64, err error) {
+	return bufio.Copy(c.Conn, &countReader{r, &c.download})
+}
+
+func (c *registryConn) Close() error {
+	c.registry.Untrack(c)
+	return c.Conn.Close()
+}
+
+func (c *registryConn) Upstream() any {
+	return c.Conn
+}
+
+type registrySession struct {
+	lastSeen        int64
+	uploadPackets   uint64
+	uploadBytes     uint64
+	downloadPackets uint64
+	downloadBytes   uint64
+	registry        *Registry
+	key             registryKey
+	natConn         io.Closer
+	id              uint64
+	sessionId       uint64
+	source          M.Socksaddr
+	destination     M.Socksaddr
+	user            any
+	start           time.Time
+	N.PacketWriter
+}
+
+func (w *registrySession) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	atomic.AddUint64(&w.downloadPackets, 1)
+	atomic.AddUint64(&w.downloadBytes, uint64(buffer.Len()))
+	atomic.StoreInt64(&w.lastSeen, time.Now().UnixNano())
+	return w.PacketWriter.WritePacket(buffer, destination)
+}
+
+func (w *registrySession) Close() error {
+	w.registry.access.Lock()
+	if w.registry.sessions[w.key] == w {
+		delete(w.registry.sessions, w.key)
+	}
+	w.registry.access.Unlock()
+	if closer, isCloser := w.PacketWriter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (w *registrySession) Upstream() any {
+	return w.PacketWriter
+}
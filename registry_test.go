@@ -0,0 +1,196 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestRegistryCloseSource(t *testing.T) {
+	t.Parallel()
+	registry := shadowsocks.NewRegistry()
+	handler := &registryHandler{started: make(chan struct{})}
+	service := shadowsocks.NewNoneService(500, handler)
+	service.SetRegistry(registry)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		service.NewConnection(context.Background(), serverConn, M.Metadata{
+			Source: M.ParseSocksaddr("10.0.0.1:1000"),
+		})
+		close(done)
+	}()
+
+	conn := shadowsocks.NewNone().DialEarlyConn(clientConn, M.ParseSocksaddr("1.1.1.1:80"))
+	go conn.Write([]byte("hello"))
+	<-handler.started
+
+	connections := registry.Connections()
+	if len(connections) != 1 {
+		t.Fatal("expected 1 connection, got ", len(connections))
+	}
+	if connections[0].Destination.String() != "1.1.1.1:80" || connections[0].Source.String() != "10.0.0.1:1000" {
+		t.Fatal("bad connection ", connections[0].Source, " -> ", connections[0].Destination)
+	}
+	if registry.CloseSource(netip.MustParseAddr("10.0.0.2")) != 0 {
+		t.Fatal("closed connection of another source")
+	}
+	if registry.CloseSource(netip.MustParseAddr("10.0.0.1")) != 1 {
+		t.Fatal("connection not closed")
+	}
+	<-done
+	if len(registry.Connections()) != 0 {
+		t.Fatal("connection not untracked")
+	}
+}
+
+func TestRegistryCloseConnection(t *testing.T) {
+	t.Parallel()
+	registry := shadowsocks.NewRegistry()
+	var peers []net.Conn
+	for _, user := range []string{"alice", "bob", "bob"} {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		registry.TrackConn(serverConn, M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")}, user)
+		peers = append(peers, clientConn)
+	}
+	var aliceID uint64
+	for _, connection := range registry.Connections() {
+		if connection.User == "alice" {
+			aliceID = connection.ID
+		}
+	}
+	if !registry.CloseConnection(aliceID) {
+		t.Fatal("connection not closed")
+	}
+	if registry.CloseConnection(aliceID) {
+		t.Fatal("closed connection closed again")
+	}
+	if _, err := peers[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected connection closed, got ", err)
+	}
+	if len(registry.Connections()) != 2 {
+		t.Fatal("expected 2 connections, got ", len(registry.Connections()))
+	}
+	if registry.CloseUser("alice") != 0 {
+		t.Fatal("closed connection of another user")
+	}
+	if closed := registry.CloseUser("bob"); closed != 2 {
+		t.Fatal("expected 2 connections closed, got ", closed)
+	}
+	if len(registry.Connections()) != 0 {
+		t.Fatal("connections not untracked")
+	}
+}
+
+func TestRegistryUntrack(t *testing.T) {
+	t.Parallel()
+	registry := shadowsocks.NewRegistry()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	conn := registry.TrackConn(serverConn, M.Metadata{}, "alice")
+	registry.Untrack(conn)
+	if len(registry.Connections()) != 0 {
+		t.Fatal("connection not untracked")
+	}
+	if registry.CloseUser("alice") != 0 {
+		t.Fatal("untracked connection closed")
+	}
+	go clientConn.Write([]byte("ping"))
+	_, err := io.ReadFull(conn, make([]byte, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistrySessions(t *testing.T) {
+	t.Parallel()
+	registry := shadowsocks.NewRegistry()
+	handler := &registryHandler{echoed: make(chan struct{})}
+	service := shadowsocks.NewNoneService(500, handler)
+	service.SetRegistry(registry)
+
+	start := time.Now()
+	for i := 1; i <= 2; i++ {
+		buffer := buf.New()
+		M.SocksaddrSerializer.WriteAddrPort(buffer, M.ParseSocksaddr("1.1.1.1:53"))
+		buffer.WriteString("ping")
+		err := service.NewPacket(context.Background(), &discardPacketConn{}, buffer, M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-handler.echoed
+		sessions := registry.Sessions()
+		if len(sessions) != 1 {
+			t.Fatal("expected 1 session, got ", len(sessions))
+		}
+		session := sessions[0]
+		if session.SessionID != 0 || session.Source.String() != "10.0.0.1:1000" || session.Destination.String() != "1.1.1.1:53" {
+			t.Fatal("bad session ", session.SessionID, " ", session.Source, " -> ", session.Destination)
+		}
+		if session.UploadPackets != uint64(i) || session.UploadBytes != uint64(4*i) || session.DownloadPackets != uint64(i) || session.DownloadBytes != uint64(4*i) {
+			t.Fatal("bad counters of packet ", i, ": ", session.UploadPackets, "/", session.UploadBytes, " up, ", session.DownloadPackets, "/", session.DownloadBytes, " down")
+		}
+		if session.LastSeen.Before(start) {
+			t.Fatal("last seen not updated")
+		}
+	}
+
+	if !registry.CloseConnection(registry.Sessions()[0].ID) {
+		t.Fatal("session not closed")
+	}
+	for i := 0; len(registry.Sessions()) > 0; i++ {
+		if i == 100 {
+			t.Fatal("session not untracked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type discardPacketConn struct {
+	N.PacketConn
+}
+
+func (c *discardPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	buffer.Release()
+	return nil
+}
+
+type registryHandler struct {
+	started chan struct{}
+	echoed  chan struct{}
+}
+
+func (h *registryHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	close(h.started)
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *registryHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	for {
+		buffer := buf.NewPacket()
+		destination, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return err
+		}
+		err = conn.WritePacket(buffer, destination)
+		if err != nil {
+			return err
+		}
+		h.echoed <- struct{}{}
+	}
+}
+
+func (h *registryHandler) NewError(ctx context.Context, err error) {
+}
@@ -0,0 +1,26 @@
+package shadowaead
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sagernet/sing-shadowsocks"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// reportError reports the events derived from err, returned by a failed handshake or packet.
+func reportError(ctx context.Context, handler shadowsocks.EventHandler, method string, network string, metadata M.Metadata, err error) {
+	event := shadowsocks.Event{Network: network, Method: method, Source: metadata.Source, Cause: err}
+	var specificTypes []shadowsocks.EventType
+	switch {
+	case errors.Is(err, ErrSaltNotUnique):
+		event.Reason = shadowsocks.RejectReasonReplay
+		specificTypes = append(specificTypes, shadowsocks.EventReplayDetected)
+	case errors.Is(err, ErrUserNotFound):
+		event.Reason = shadowsocks.RejectReasonUnknownUser
+		specificTypes = append(specificTypes, shadowsocks.EventUnknownUser)
+	case errors.Is(err, ErrBadHeader):
+		event.Reason = shadowsocks.RejectReasonBadHeader
+	}
+	shadowsocks.ReportRejected(ctx, handler, event, specificTypes...)
+}
@@ -8,24 +8,30 @@ import (
 	"io"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
 
 	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowreplay"
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/replay"
 	"github.com/sagernet/sing/common/rw"
 	"github.com/sagernet/sing/common/udpnat"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
-var ErrBadHeader = E.New("bad header")
+var (
+	ErrBadHeader     = E.New("bad header")
+	ErrSaltNotUnique = E.New("salt not unique")
+)
 
-var _ shadowsocks.Service = (*Service)(nil)
+var _ shadowsocks.ShutdownService = (*Service)(nil)
 
 type Service struct {
 	name          string
@@ -35,13 +41,38 @@ type Service struct {
 	password      string
 	handler       shadowsocks.Handler
 	udpNat        *udpnat.Service[netip.AddrPort]
+	replayFilter  replay.Filter
+	failurePolicy shadowsocks.FailurePolicy
+	registry      *shadowsocks.Registry
+	events        shadowsocks.EventHandler
+	shutdown      shadowsocks.ShutdownGroup
+	mux           bool
 }
 
 func NewService(method string, key []byte, password string, udpTimeout int64, handler shadowsocks.Handler) (*Service, error) {
+	s, err := newService(method, udpTimeout, handler)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == s.keySaltLength {
+		s.key = key
+	} else if len(key) > 0 {
+		return nil, shadowsocks.ErrBadKey
+	} else if password != "" {
+		s.key = shadowsocks.Key([]byte(password), s.keySaltLength)
+	} else {
+		return nil, shadowsocks.ErrMissingPassword
+	}
+	s.password = password
+	return s, nil
+}
+
+func newService(method string, udpTimeout int64, handler shadowsocks.Handler) (*Service, error) {
 	s := &Service{
-		name:    method,
-		handler: handler,
-		udpNat:  udpnat.New[netip.AddrPort](udpTimeout, handler),
+		name:         method,
+		handler:      handler,
+		udpNat:       udpnat.New[netip.AddrPort](udpTimeout, handler),
+		replayFilter: shadowreplay.NewBloomRing(shadowreplay.DefaultCapacity, 0),
 	}
 	switch method {
 	case "aes-128-gcm":
@@ -59,15 +90,8 @@ func NewService(method string, key []byte, password string, udpTimeout int64, ha
 	case "xchacha20-ietf-poly1305":
 		s.keySaltLength = 32
 		s.constructor = chacha20poly1305.NewX
-	}
-	if len(key) == s.keySaltLength {
-		s.key = key
-	} else if len(key) > 0 {
-		return nil, shadowsocks.ErrBadKey
-	} else if password != "" {
-		s.key = shadowsocks.Key([]byte(password), s.keySaltLength)
-	} else {
-		return nil, shadowsocks.ErrMissingPassword
+	default:
+		return nil, os.ErrInvalid
 	}
 	return s, nil
 }
@@ -80,10 +104,56 @@ func (s *Service) Password() string {
 	return s.password
 }
 
+// SetReplayFilter replaces the salt replay filter, nil disables replay protection.
+func (s *Service) SetReplayFilter(filter replay.Filter) {
+	s.replayFilter = filter
+}
+
+// SetFailurePolicy sets how connections that fail the handshake are handled, nil resets them.
+func (s *Service) SetFailurePolicy(policy shadowsocks.FailurePolicy) {
+	s.failurePolicy = policy
+}
+
+// SetRegistry enables tracking of live connections and UDP sessions, nil disables it.
+func (s *Service) SetRegistry(registry *shadowsocks.Registry) {
+	s.registry = registry
+}
+
+// SetEventHandler sets the handler of structured events, nil disables them.
+func (s *Service) SetEventHandler(handler shadowsocks.EventHandler) {
+	s.events = handler
+}
+
+// SetMux enables serving mux sessions, each stream is tracked as a connection.
+func (s *Service) SetMux(enabled bool) {
+	s.mux = enabled
+}
+
+func (s *Service) handleConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, user any) error {
+	if s.mux {
+		return shadowsocks.HandleMuxConnection(ctx, s.handler, conn, metadata, shadowsocks.MuxOptions{Registry: s.registry, User: user, Shutdown: &s.shutdown})
+	}
+	return shadowsocks.HandleConnection(ctx, s.handler, conn, metadata)
+}
+
+func (s *Service) checkSalt(salt []byte) bool {
+	return s.replayFilter == nil || s.replayFilter.Check(salt)
+}
+
 func (s *Service) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	return s.serveConnection(ctx, conn, metadata, s.newConnection)
+}
+
+func (s *Service) serveConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, serve func(ctx context.Context, conn net.Conn, metadata M.Metadata) error) error {
+	var err error
+	if s.shutdown.AcquireConn(conn) {
+		err = shadowsocks.ServeConnection(ctx, conn, metadata, s.failurePolicy, serve)
+		s.shutdown.ReleaseConn(conn)
+	} else {
+		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: shadowsocks.ErrServiceClosed, Handshake: true}
+	}
+	if s.events != nil && shadowsocks.IsHandshakeError(err) {
+		reportError(ctx, s.events, s.name, N.NetworkTCP, metadata, err)
 	}
 	return err
 }
@@ -117,6 +187,10 @@ func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.M
 		return err
 	}
 
+	if !s.checkSalt(header.To(s.keySaltLength)) {
+		return ErrSaltNotUnique
+	}
+
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
 	if err != nil {
 		return err
@@ -124,12 +198,21 @@ func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.M
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-
-	return s.handler.NewConnection(ctx, &serverConn{
+	latency := shadowsocks.HandshakeSuccess(conn)
+	if s.events != nil {
+		s.events.HandleEvent(ctx, shadowsocks.Event{Type: shadowsocks.EventHandshakeAccepted, Network: N.NetworkTCP, Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: nil, Latency: latency})
+	}
+	var protocolConn net.Conn = &serverConn{
 		Service: s,
 		Conn:    conn,
+		key:     s.key,
 		reader:  reader,
-	}, metadata)
+	}
+	if s.registry != nil {
+		protocolConn = s.registry.TrackConn(protocolConn, metadata, nil)
+		defer s.registry.Untrack(protocolConn)
+	}
+	return s.handleConnection(ctx, protocolConn, metadata, nil)
 }
 
 func (s *Service) NewError(ctx context.Context, err error) {
@@ -139,6 +222,7 @@ func (s *Service) NewError(ctx context.Context, err error) {
 type serverConn struct {
 	*Service
 	net.Conn
+	key    []byte
 	access sync.Mutex
 	reader *Reader
 	writer *Writer
@@ -148,6 +232,7 @@ func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
 	_salt := buf.StackNewSize(c.keySaltLength)
 	salt := common.Dup(_salt)
 	salt.WriteRandom(c.keySaltLength)
+	c.checkSalt(salt.Bytes())
 
 	_key := buf.StackNewSize(c.keySaltLength)
 	key := common.Dup(_key)
@@ -221,18 +306,30 @@ func (s *Service) ReaderMTU() int {
 	return MaxPacketSize
 }
 
+// Shutdown stops accepting new connections and packets, see shadowsocks.ShutdownGroup.
+func (s *Service) Shutdown(ctx context.Context) (int, error) {
+	return s.shutdown.Shutdown(ctx)
+}
+
 func (s *Service) WriteIsThreadUnsafe() {
 }
 
 func (s *Service) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
 	err := s.newPacket(ctx, conn, buffer, metadata)
 	if err != nil {
+		if s.events != nil {
+			reportError(ctx, s.events, s.name, N.NetworkUDP, metadata, err)
+		}
 		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
 func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	if !s.shutdown.AcquirePacket() {
+		return shadowsocks.ErrServiceClosed
+	}
+	defer s.shutdown.ReleasePacket()
 	if buffer.Len() < s.keySaltLength {
 		return io.ErrShortBuffer
 	}
@@ -249,6 +346,9 @@ func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.
 	if err != nil {
 		return err
 	}
+	if !s.checkSalt(buffer.To(s.keySaltLength)) {
+		return ErrSaltNotUnique
+	}
 	buffer.Advance(s.keySaltLength)
 	buffer.Truncate(len(packet))
 
@@ -259,9 +359,21 @@ func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	s.udpNat.NewPacket(ctx, metadata.Source.AddrPort(), buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
-		return &serverPacketWriter{s, conn, natConn}
+	source := metadata.Source.AddrPort()
+	packetLen := buffer.Len()
+	s.udpNat.NewPacket(ctx, source, buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
+		var writer N.PacketWriter = &serverPacketWriter{s, conn, natConn, s.key}
+		if s.registry != nil {
+			writer = s.registry.TrackPacketWriter(s, source, 0, natConn, writer, metadata, nil)
+		}
+		if s.events != nil {
+			writer = shadowsocks.SessionEventWriter(ctx, s.events, shadowsocks.Event{Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: nil}, writer)
+		}
+		return s.shutdown.TrackPacketWriter(natConn, writer)
 	})
+	if s.registry != nil {
+		s.registry.TrackPacket(s, source, packetLen)
+	}
 	return nil
 }
 
@@ -269,11 +381,13 @@ type serverPacketWriter struct {
 	*Service
 	source N.PacketConn
 	nat    N.PacketConn
+	key    []byte
 }
 
 func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
 	header := buffer.ExtendHeader(w.keySaltLength + M.SocksaddrSerializer.AddrPortLen(destination))
 	common.Must1(io.ReadFull(rand.Reader, header[:w.keySaltLength]))
+	w.checkSalt(header[:w.keySaltLength])
 	err := M.SocksaddrSerializer.WriteAddrPort(buf.With(header[w.keySaltLength:]), destination)
 	if err != nil {
 		buffer.Release()
@@ -0,0 +1,237 @@
+package shadowaead
+
+import (
+	"context"
+	"crypto/cipher"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/rw"
+)
+
+var ErrUserNotFound = E.New("no matching user")
+
+var _ shadowsocks.ShutdownService = (*MultiService[int])(nil)
+
+type MultiService[U comparable] struct {
+	*Service
+
+	access  sync.RWMutex
+	users   []multiUser[U]
+	tracker *shadowsocks.TrafficTracker[U]
+}
+
+type multiUser[U comparable] struct {
+	user U
+	key  []byte
+}
+
+func NewMultiService[U comparable](method string, udpTimeout int64, handler shadowsocks.Handler) (*MultiService[U], error) {
+	s, err := newService(method, udpTimeout, handler)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiService[U]{Service: s}, nil
+}
+
+// SetTrafficTracker enables per-user traffic accounting, nil disables it.
+func (s *MultiService[U]) SetTrafficTracker(tracker *shadowsocks.TrafficTracker[U]) {
+	s.tracker = tracker
+}
+
+func (s *MultiService[U]) UpdateUsers(userList []U, keyList [][]byte) error {
+	if len(userList) != len(keyList) {
+		return shadowsocks.ErrListLengthMismatch
+	}
+	users := make([]multiUser[U], 0, len(userList))
+	for i, user := range userList {
+		key := keyList[i]
+		if len(key) != s.keySaltLength {
+			return shadowsocks.ErrBadKey
+		}
+		users = append(users, multiUser[U]{user, key})
+	}
+	s.access.Lock()
+	s.users = users
+	s.access.Unlock()
+	return nil
+}
+
+func (s *MultiService[U]) loadUsers() []multiUser[U] {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return s.users
+}
+
+func (s *MultiService[U]) UpdateUsersWithPasswords(userList []U, passwordList []string) error {
+	keyList := make([][]byte, 0, len(passwordList))
+	for _, password := range passwordList {
+		if password == "" {
+			return shadowsocks.ErrMissingPassword
+		}
+		keyList = append(keyList, shadowsocks.Key([]byte(password), s.keySaltLength))
+	}
+	return s.UpdateUsers(userList, keyList)
+}
+
+func (s *MultiService[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return s.serveConnection(ctx, conn, metadata, s.newConnection)
+}
+
+func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_header := buf.StackNewSize(s.keySaltLength + PacketLengthBufferSize + Overhead)
+	defer common.KeepAlive(_header)
+	header := common.Dup(_header)
+	defer header.Release()
+
+	_, err := header.ReadOnceFrom(conn)
+	if err != nil {
+		return E.Cause(err, "read header")
+	} else if !header.IsFull() {
+		return ErrBadHeader
+	}
+
+	var lengthBuffer [PacketLengthBufferSize]byte
+	for _, user := range s.loadUsers() {
+		readCipher, err := s.cipher(user.key, header.To(s.keySaltLength))
+		if err != nil {
+			return err
+		}
+		_, err = readCipher.Open(lengthBuffer[:0], rw.ZeroBytes[:readCipher.NonceSize()], header.From(s.keySaltLength), nil)
+		if err != nil {
+			continue
+		}
+
+		reader := NewReader(conn, readCipher, MaxPacketSize)
+		err = reader.ReadWithLengthChunk(header.From(s.keySaltLength))
+		if err != nil {
+			return err
+		}
+
+		if !s.checkSalt(header.To(s.keySaltLength)) {
+			return ErrSaltNotUnique
+		}
+
+		destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
+		if err != nil {
+			return err
+		}
+
+		metadata.Protocol = "shadowsocks"
+		metadata.Destination = destination
+		var protocolConn net.Conn = &serverConn{
+			Service: s.Service,
+			Conn:    conn,
+			key:     user.key,
+			reader:  reader,
+		}
+		if s.tracker != nil {
+			protocolConn = s.tracker.TrackConn(user.user, protocolConn)
+		}
+		if s.registry != nil {
+			protocolConn = s.registry.TrackConn(protocolConn, metadata, user.user)
+			defer s.registry.Untrack(protocolConn)
+		}
+		latency := shadowsocks.HandshakeSuccess(conn)
+		if s.events != nil {
+			s.events.HandleEvent(ctx, shadowsocks.Event{Type: shadowsocks.EventHandshakeAccepted, Network: N.NetworkTCP, Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: user.user, Latency: latency})
+		}
+		return s.handleConnection(auth.ContextWithUser(ctx, user.user), protocolConn, metadata, user.user)
+	}
+	return ErrUserNotFound
+}
+
+func (s *MultiService[U]) cipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	_subKey := buf.StackNewSize(s.keySaltLength)
+	defer common.KeepAlive(_subKey)
+	subKey := common.Dup(_subKey)
+	defer subKey.Release()
+	Kdf(key, salt, subKey)
+	return s.constructor(subKey.Bytes())
+}
+
+func (s *MultiService[U]) WriteIsThreadUnsafe() {
+}
+
+func (s *MultiService[U]) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	err := s.newPacket(ctx, conn, buffer, metadata)
+	if err != nil {
+		if s.events != nil {
+			reportError(ctx, s.events, s.name, N.NetworkUDP, metadata, err)
+		}
+		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
+	}
+	return err
+}
+
+func (s *MultiService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	if !s.shutdown.AcquirePacket() {
+		return shadowsocks.ErrServiceClosed
+	}
+	defer s.shutdown.ReleasePacket()
+	if buffer.Len() < s.keySaltLength+Overhead {
+		return io.ErrShortBuffer
+	}
+
+	_packet := buf.StackNewSize(buffer.Len())
+	defer common.KeepAlive(_packet)
+	packetBuffer := common.Dup(_packet)
+	defer packetBuffer.Release()
+
+	for _, user := range s.loadUsers() {
+		readCipher, err := s.cipher(user.key, buffer.To(s.keySaltLength))
+		if err != nil {
+			return err
+		}
+		packet, err := readCipher.Open(packetBuffer.Index(0), rw.ZeroBytes[:readCipher.NonceSize()], buffer.From(s.keySaltLength), nil)
+		if err != nil {
+			continue
+		}
+		if !s.checkSalt(buffer.To(s.keySaltLength)) {
+			return ErrSaltNotUnique
+		}
+		buffer.Advance(s.keySaltLength)
+		buffer.Truncate(copy(buffer.Bytes(), packet))
+
+		destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
+		if err != nil {
+			return err
+		}
+
+		user := user
+		metadata.Protocol = "shadowsocks"
+		metadata.Destination = destination
+		tracker := s.tracker
+		if tracker != nil {
+			tracker.TrackUpload(user.user, buffer.Len())
+		}
+		source := metadata.Source.AddrPort()
+		packetLen := buffer.Len()
+		s.udpNat.NewContextPacket(ctx, source, buffer, metadata, func(natConn N.PacketConn) (context.Context, N.PacketWriter) {
+			var writer N.PacketWriter = &serverPacketWriter{s.Service, conn, natConn, user.key}
+			if tracker != nil {
+				writer = tracker.TrackPacketWriter(user.user, writer)
+			}
+			if s.registry != nil {
+				writer = s.registry.TrackPacketWriter(s.Service, source, 0, natConn, writer, metadata, user.user)
+			}
+			if s.events != nil {
+				writer = shadowsocks.SessionEventWriter(ctx, s.events, shadowsocks.Event{Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: user.user}, writer)
+			}
+			return auth.ContextWithUser(ctx, user.user), s.shutdown.TrackPacketWriter(natConn, writer)
+		})
+		if s.registry != nil {
+			s.registry.TrackPacket(s.Service, source, packetLen)
+		}
+		return nil
+	}
+	return ErrUserNotFound
+}
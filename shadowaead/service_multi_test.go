@@ -0,0 +1,130 @@
+package shadowaead_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestMultiService(t *testing.T) {
+	t.Parallel()
+	method := "aes-128-gcm"
+
+	var wg sync.WaitGroup
+
+	multiService, err := shadowaead.NewMultiService[string](method, 500, &multiHandler{t, &wg, "user 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsersWithPasswords([]string{"user 1", "user 2"}, []string{"password 1", "password 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := shadowaead.New(method, nil, "password 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go func() {
+		err := multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+		if err != nil {
+			serverConn.Close()
+			t.Error(E.Cause(err, "server"))
+			return
+		}
+	}()
+	_, err = client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestMultiServiceUpdateUsers(t *testing.T) {
+	t.Parallel()
+	method := "aes-128-gcm"
+	var wg sync.WaitGroup
+	multiService, err := shadowaead.NewMultiService[string](method, 500, &multiHandler{t, &wg, "user 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsersWithPasswords([]string{"user 1", "user 2"}, []string{"password 1"})
+	if !errors.Is(err, shadowsocks.ErrListLengthMismatch) {
+		t.Fatal("expected list length mismatch, got ", err)
+	}
+	err = multiService.UpdateUsers([]string{"user 1"}, nil)
+	if !errors.Is(err, shadowsocks.ErrListLengthMismatch) {
+		t.Fatal("expected list length mismatch, got ", err)
+	}
+
+	client, err := shadowaead.New(method, nil, "password 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// users are replaced while connections are served
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			multiService.UpdateUsersWithPasswords([]string{"user 1", "user 2"}, []string{"password 1", "password 2"})
+		}
+	}()
+	multiService.UpdateUsersWithPasswords([]string{"user 2"}, []string{"password 2"})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			err := multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+			if err != nil {
+				t.Error(E.Cause(err, "server"))
+			}
+			serverConn.Close()
+		}()
+		_, err = client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		clientConn.Close()
+	}
+	<-done
+}
+
+type multiHandler struct {
+	t    *testing.T
+	wg   *sync.WaitGroup
+	user string
+}
+
+func (h *multiHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if metadata.Destination.String() != "test.com:443" {
+		h.t.Error("bad destination")
+	}
+	if user, _ := auth.UserFromContext[string](ctx); user != h.user {
+		h.t.Error("bad user")
+	}
+	h.wg.Done()
+	return nil
+}
+
+func (h *multiHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *multiHandler) NewError(ctx context.Context, err error) {
+	h.t.Error(ctx, err)
+}
@@ -0,0 +1,45 @@
+package shadowaead_2022
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// reportError reports the events derived from err, returned by a failed handshake or packet.
+func reportError(ctx context.Context, handler shadowsocks.EventHandler, method string, network string, metadata M.Metadata, err error) {
+	event := shadowsocks.Event{Network: network, Method: method, Source: metadata.Source, Cause: err}
+	var (
+		timestampErr  *TimestampError
+		packetIdErr   *PacketIDError
+		limitErr      *LimitError
+		specificTypes []shadowsocks.EventType
+	)
+	switch {
+	case errors.Is(err, ErrSaltNotUnique):
+		event.Reason = shadowsocks.RejectReasonReplay
+		specificTypes = append(specificTypes, shadowsocks.EventReplayDetected)
+	case errors.As(err, &timestampErr):
+		event.Reason = shadowsocks.RejectReasonBadTimestamp
+		event.TimeDiff = timestampErr.Diff
+		specificTypes = append(specificTypes, shadowsocks.EventTimestampSkew)
+	case errors.As(err, &packetIdErr):
+		event.Reason = shadowsocks.RejectReasonReplay
+		event.SessionID = packetIdErr.SessionID
+		event.PacketID = packetIdErr.PacketID
+		specificTypes = append(specificTypes, shadowsocks.EventPacketIDRejected)
+	case errors.Is(err, ErrUnknownIdentity):
+		event.Reason = shadowsocks.RejectReasonUnknownUser
+		specificTypes = append(specificTypes, shadowsocks.EventUnknownUser)
+	case errors.As(err, &limitErr):
+		event.Reason = shadowsocks.RejectReasonLimit
+		event.User = limitErr.User
+	case E.IsMulti(err, shadowaead.ErrBadHeader, ErrBadHeaderType, ErrPacketTooShort, ErrNoPadding, ErrBadPadding):
+		event.Reason = shadowsocks.RejectReasonBadHeader
+	}
+	shadowsocks.ReportRejected(ctx, handler, event, specificTypes...)
+}
@@ -0,0 +1,127 @@
+package shadowaead_2022_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestServiceEvents(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	var wg sync.WaitGroup
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &multiHandler{t, &wg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := &eventRecorder{}
+	service.(*shadowaead_2022.Service).SetEventHandler(events)
+
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := &writeRecorder{}
+	_, err = client.DialEarlyConn(handshake, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := M.ParseSocksaddr("10.0.0.1:1000")
+	wg.Add(1)
+	for i := 0; i < 2; i++ {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			clientConn.Write(handshake.buffer.Bytes())
+			clientConn.Close()
+		}()
+		err = service.NewConnection(context.Background(), serverConn, M.Metadata{Source: source})
+		serverConn.Close()
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !errors.Is(err, shadowaead_2022.ErrSaltNotUnique) {
+		t.Fatal("expected replay rejected, got ", err)
+	}
+
+	expected := []shadowsocks.EventType{shadowsocks.EventHandshakeAccepted, shadowsocks.EventReplayDetected, shadowsocks.EventHandshakeRejected}
+	if len(events.events) != len(expected) {
+		t.Fatal("expected ", len(expected), " events, got ", len(events.events))
+	}
+	for i, event := range events.events {
+		if event.Type != expected[i] {
+			t.Fatal("event ", i, ": expected ", expected[i], ", got ", event.Type)
+		}
+		if event.Method != method || event.Source != source {
+			t.Fatal("event ", i, ": bad method ", event.Method, " or source ", event.Source)
+		}
+	}
+	if events.events[0].Destination.String() != "test.com:443" {
+		t.Fatal("bad destination ", events.events[0].Destination)
+	}
+	if events.events[2].Reason != shadowsocks.RejectReasonReplay {
+		t.Fatal("expected replay reason, got ", events.events[2].Reason)
+	}
+}
+
+func TestServicePacketEvents(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &multiHandler{t, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := &eventRecorder{}
+	service.(*shadowaead_2022.Service).SetEventHandler(events)
+
+	buffer := buf.New()
+	buffer.Write(make([]byte, 10))
+	err = service.NewPacket(context.Background(), nil, buffer, M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+	if !errors.Is(err, shadowaead_2022.ErrPacketTooShort) {
+		t.Fatal("expected packet too short, got ", err)
+	}
+	if len(events.events) != 1 {
+		t.Fatal("expected 1 event, got ", len(events.events))
+	}
+	event := events.events[0]
+	if event.Type != shadowsocks.EventPacketRejected || event.Network != N.NetworkUDP || event.Reason != shadowsocks.RejectReasonBadHeader {
+		t.Fatal("bad event ", event.Type, " ", event.Network, " ", event.Reason)
+	}
+}
+
+type eventRecorder struct {
+	access sync.Mutex
+	events []shadowsocks.Event
+}
+
+func (r *eventRecorder) HandleEvent(ctx context.Context, event shadowsocks.Event) {
+	r.access.Lock()
+	r.events = append(r.events, event)
+	r.access.Unlock()
+}
+
+type writeRecorder struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (c *writeRecorder) Write(p []byte) (int, error) {
+	return c.buffer.Write(p)
+}
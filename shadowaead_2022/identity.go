@@ -0,0 +1,57 @@
+package shadowaead_2022
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"github.com/sagernet/sing/common/buf"
+
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/chacha20"
+)
+
+func IdentitySubkey(psk []byte, salt []byte, keyLength int) []byte {
+	keyMaterial := buf.Make(len(psk) + len(salt))
+	copy(keyMaterial, psk)
+	copy(keyMaterial[len(psk):], salt)
+	outKey := buf.Make(keyLength)
+	blake3.DeriveKey("shadowsocks 2022 identity subkey", keyMaterial, outKey)
+	return outKey
+}
+
+// encryptIdentityHeader encrypts a psk hash into an extended identity header.
+// AES methods encrypt it as a single block, ChaCha methods, which have no block cipher,
+// XOR it with a XChaCha20 keystream of the identity subkey.
+func encryptIdentityHeader(blockConstructor func(key []byte) (cipher.Block, error), subkey []byte, dst []byte, pskHash []byte) error {
+	if blockConstructor == nil {
+		return xorIdentityHeader(subkey, dst, pskHash)
+	}
+	b, err := blockConstructor(subkey)
+	if err != nil {
+		return err
+	}
+	b.Encrypt(dst, pskHash)
+	return nil
+}
+
+func decryptIdentityHeader(blockConstructor func(key []byte) (cipher.Block, error), subkey []byte, dst []byte, header []byte) error {
+	if blockConstructor == nil {
+		return xorIdentityHeader(subkey, dst, header)
+	}
+	b, err := blockConstructor(subkey)
+	if err != nil {
+		return err
+	}
+	b.Decrypt(dst, header)
+	return nil
+}
+
+func xorIdentityHeader(subkey []byte, dst []byte, src []byte) error {
+	var nonce [chacha20.NonceSizeX]byte
+	stream, err := chacha20.NewUnauthenticatedCipher(subkey, nonce[:])
+	if err != nil {
+		return err
+	}
+	stream.XORKeyStream(dst[:aes.BlockSize], src[:aes.BlockSize])
+	return nil
+}
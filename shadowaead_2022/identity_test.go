@@ -0,0 +1,256 @@
+package shadowaead_2022_test
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestMultiServiceChaCha(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-chacha20-poly1305"
+	var iPSK, uPSK [32]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	var wg sync.WaitGroup
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, &echoHandler{multiHandler{t, &wg}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Add(1)
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go func() {
+		err := multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+		if err != nil {
+			serverConn.Close()
+			t.Error(E.Cause(err, "server"))
+		}
+	}()
+	_, err = client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	go func() {
+		packetConn := bufio.NewPacketConn(listener)
+		for {
+			buffer := buf.NewPacket()
+			source, err := packetConn.ReadPacket(buffer)
+			if err != nil {
+				buffer.Release()
+				return
+			}
+			err = multiService.NewPacket(context.Background(), packetConn, buffer, M.Metadata{Source: source})
+			if err != nil {
+				buffer.Release()
+				t.Error(err)
+			}
+		}
+	}()
+
+	udpConn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConn := client.DialPacketConn(udpConn)
+	defer packetConn.Close()
+	packetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	_, err = packetConn.WriteTo([]byte("ping"), destination.UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 1024)
+	n, addr, err := packetConn.ReadFrom(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response[:n]) != "ping" || addr.String() != destination.String() {
+		t.Fatal("bad response ", string(response[:n]), " from ", addr)
+	}
+}
+
+func TestRelayServiceChaCha(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-chacha20-poly1305"
+	var iPSK, uPSK [32]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	var wg sync.WaitGroup
+	service, err := shadowaead_2022.NewService(method, uPSK[:], 500, &multiHandler{t, &wg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayService, err := shadowaead_2022.NewRelayService[string](method, iPSK[:], 500, &relayHandler{service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = relayService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]}, []M.Socksaddr{M.ParseSocksaddr("127.0.0.1:8388")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Add(1)
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go func() {
+		err := relayService.NewConnection(context.Background(), serverConn, M.Metadata{})
+		if err != nil {
+			serverConn.Close()
+			t.Error(E.Cause(err, "relay"))
+		}
+	}()
+	_, err = client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestRelayServiceChaChaPacketSession(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-chacha20-poly1305"
+	var iPSK, uPSK [32]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	handler := &relaySessionHandler{packets: make(chan string, 2)}
+	relayService, err := shadowaead_2022.NewRelayService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = relayService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]}, []M.Socksaddr{M.ParseSocksaddr("127.0.0.1:8388")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureConn := &packetCaptureConn{}
+	packetConn := client.DialPacketConn(captureConn)
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	// the client moves to another source address between the packets
+	for _, source := range []string{"10.0.0.1:1000", "10.0.0.2:2000"} {
+		_, err = packetConn.WriteTo([]byte("ping"), destination.UDPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := buf.As(captureConn.packets[len(captureConn.packets)-1])
+		err = relayService.NewPacket(context.Background(), nil, buffer, M.Metadata{Source: M.ParseSocksaddr(source)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handler.packets:
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet not relayed")
+		}
+	}
+	handler.access.Lock()
+	sessions := handler.sessions
+	handler.access.Unlock()
+	if sessions != 1 {
+		t.Fatal("expected 1 session, got ", sessions)
+	}
+}
+
+type packetCaptureConn struct {
+	net.Conn
+	packets [][]byte
+}
+
+func (c *packetCaptureConn) Write(p []byte) (int, error) {
+	c.packets = append(c.packets, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+type relaySessionHandler struct {
+	relayHandler
+	access   sync.Mutex
+	sessions int
+	packets  chan string
+}
+
+func (h *relaySessionHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.access.Lock()
+	h.sessions++
+	h.access.Unlock()
+	for {
+		buffer := buf.NewPacket()
+		_, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return err
+		}
+		h.packets <- metadata.Source.String()
+		buffer.Release()
+	}
+}
+
+type echoHandler struct {
+	multiHandler
+}
+
+func (h *echoHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	buffer := buf.NewPacket()
+	destination, err := conn.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	return conn.WritePacket(buffer, destination)
+}
+
+type relayHandler struct {
+	upstream interface {
+		NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error
+	}
+}
+
+func (h *relayHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return h.upstream.NewConnection(ctx, conn, M.Metadata{})
+}
+
+func (h *relayHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *relayHandler) NewError(ctx context.Context, err error) {
+}
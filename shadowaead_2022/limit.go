@@ -0,0 +1,281 @@
+package shadowaead_2022
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var (
+	ErrQuotaExceeded      = E.New("quota exceeded")
+	ErrTooManyConnections = E.New("too many connections")
+	ErrTooManyUDPSessions = E.New("too many udp sessions")
+)
+
+// UserLimit describes the limits of a user, zero values mean unlimited.
+type UserLimit struct {
+	// MaxBytes is the upload and download byte quota per Period, or in total if Period is zero.
+	MaxBytes uint64
+	Period   time.Duration
+	// BytesPerSecond is the token bucket rate shared by upload and download.
+	BytesPerSecond uint64
+	MaxConnections int
+	MaxUDPSessions int
+}
+
+type LimitError struct {
+	User  any
+	Cause error
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *LimitError) Error() string {
+	return F.ToString("user ", e.User, ": ", e.Cause)
+}
+
+type userLimiter struct {
+	access         sync.Mutex
+	clock          Clock
+	limit          UserLimit
+	periodStart    time.Time
+	periodBytes    uint64
+	tokens         float64
+	lastRefill     time.Time
+	tcpConnections int
+	udpSessions    int
+}
+
+func newUserLimiter(clock Clock, limit UserLimit) *userLimiter {
+	now := clock.Now()
+	return &userLimiter{
+		clock:       clock,
+		limit:       limit,
+		periodStart: now,
+		tokens:      float64(limit.BytesPerSecond),
+		lastRefill:  now,
+	}
+}
+
+func (l *userLimiter) update(limit UserLimit) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if limit.Period != l.limit.Period {
+		l.periodStart = l.clock.Now()
+		l.periodBytes = 0
+	}
+	if limit.BytesPerSecond != l.limit.BytesPerSecond {
+		l.tokens = float64(limit.BytesPerSecond)
+		l.lastRefill = l.clock.Now()
+	}
+	l.limit = limit
+}
+
+// remove lifts the limits of a user removed from the limit list, the quota period and
+// counters are kept for when the user is added back while its sessions are still live.
+// It returns false if the user has no live sessions, so the limiter can be dropped.
+func (l *userLimiter) remove() bool {
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.limit = UserLimit{Period: l.limit.Period}
+	return l.tcpConnections > 0 || l.udpSessions > 0
+}
+
+func (l *userLimiter) checkQuotaLocked(now time.Time) error {
+	if l.limit.MaxBytes == 0 {
+		return nil
+	}
+	if l.limit.Period > 0 && now.Sub(l.periodStart) >= l.limit.Period {
+		l.periodStart = now
+		l.periodBytes = 0
+	}
+	if l.periodBytes >= l.limit.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (l *userLimiter) checkQuota() error {
+	l.access.Lock()
+	defer l.access.Unlock()
+	return l.checkQuotaLocked(l.clock.Now())
+}
+
+// consume accounts n bytes and returns how long the caller should wait to respect the rate limit.
+func (l *userLimiter) consume(n int) time.Duration {
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.periodBytes += uint64(n)
+	if l.limit.BytesPerSecond == 0 {
+		return 0
+	}
+	now := l.clock.Now()
+	rate := float64(l.limit.BytesPerSecond)
+	l.tokens += now.Sub(l.lastRefill).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.lastRefill = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// allowPacket accounts a packet without waiting, returns false if it should be dropped.
+// A packet larger than the rate passes once the bucket is full and leaves it in debt,
+// like consume does for TCP, instead of being dropped forever.
+func (l *userLimiter) allowPacket(n int) (bool, error) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	now := l.clock.Now()
+	err := l.checkQuotaLocked(now)
+	if err != nil {
+		return false, err
+	}
+	if l.limit.BytesPerSecond > 0 {
+		rate := float64(l.limit.BytesPerSecond)
+		l.tokens += now.Sub(l.lastRefill).Seconds() * rate
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+		l.lastRefill = now
+		if l.tokens < float64(n) && l.tokens < rate {
+			return false, nil
+		}
+		l.tokens -= float64(n)
+	}
+	l.periodBytes += uint64(n)
+	return true, nil
+}
+
+func (l *userLimiter) acquireConnection() error {
+	l.access.Lock()
+	defer l.access.Unlock()
+	err := l.checkQuotaLocked(l.clock.Now())
+	if err != nil {
+		return err
+	}
+	if l.limit.MaxConnections > 0 && l.tcpConnections >= l.limit.MaxConnections {
+		return ErrTooManyConnections
+	}
+	l.tcpConnections++
+	return nil
+}
+
+func (l *userLimiter) releaseConnection() {
+	l.access.Lock()
+	l.tcpConnections--
+	l.access.Unlock()
+}
+
+func (l *userLimiter) tryAcquireUDPSession() error {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.limit.MaxUDPSessions > 0 && l.udpSessions >= l.limit.MaxUDPSessions {
+		return ErrTooManyUDPSessions
+	}
+	l.udpSessions++
+	return nil
+}
+
+func (l *userLimiter) acquireUDPSession() {
+	l.access.Lock()
+	l.udpSessions++
+	l.access.Unlock()
+}
+
+func (l *userLimiter) releaseUDPSession() {
+	l.access.Lock()
+	l.udpSessions--
+	l.access.Unlock()
+}
+
+type limitConn struct {
+	net.Conn
+	user    any
+	limiter *userLimiter
+	// counted is set if the connection holds one of the connections of the user
+	counted bool
+	closed  uint32
+}
+
+func (c *limitConn) Read(p []byte) (n int, err error) {
+	err = c.limiter.checkQuota()
+	if err != nil {
+		return 0, &LimitError{c.user, err}
+	}
+	n, err = c.Conn.Read(p)
+	if n > 0 {
+		time.Sleep(c.limiter.consume(n))
+	}
+	return
+}
+
+func (c *limitConn) Write(p []byte) (n int, err error) {
+	err = c.limiter.checkQuota()
+	if err != nil {
+		return 0, &LimitError{c.user, err}
+	}
+	time.Sleep(c.limiter.consume(len(p)))
+	return c.Conn.Write(p)
+}
+
+func (c *limitConn) release() {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) && c.counted {
+		c.limiter.releaseConnection()
+	}
+}
+
+func (c *limitConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *limitConn) Upstream() any {
+	return c.Conn
+}
+
+type limitPacketWriter struct {
+	N.PacketWriter
+	user    any
+	limiter *userLimiter
+	closed  uint32
+}
+
+func (w *limitPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	allow, err := w.limiter.allowPacket(buffer.Len())
+	if !allow {
+		buffer.Release()
+		if err != nil {
+			return &LimitError{w.user, err}
+		}
+		return nil
+	}
+	return w.PacketWriter.WritePacket(buffer, destination)
+}
+
+func (w *limitPacketWriter) Close() error {
+	if atomic.CompareAndSwapUint32(&w.closed, 0, 1) {
+		w.limiter.releaseUDPSession()
+	}
+	if closer, isCloser := w.PacketWriter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (w *limitPacketWriter) Upstream() any {
+	return w.PacketWriter
+}
@@ -0,0 +1,487 @@
+package shadowaead_2022_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowmux"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestMultiServiceConnectionLimit(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+
+	handler := &limitHandler{
+		accepted: make(chan struct{}, 2),
+		release:  make(chan struct{}),
+	}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uPSK [16]byte
+	rand.Reader.Read(uPSK[:])
+	multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	multiService.UpdateLimits([]string{"my user"}, []shadowaead_2022.UserLimit{{MaxConnections: 1}})
+	dial := limitDialer(t, method, multiService, iPSK[:], uPSK[:])
+
+	first := dial()
+	<-handler.accepted
+
+	err = <-dial()
+	if !errors.Is(err, shadowaead_2022.ErrTooManyConnections) {
+		t.Fatal("expected connection limit, got ", err)
+	}
+	var limitErr *shadowaead_2022.LimitError
+	if !errors.As(err, &limitErr) || limitErr.User != "my user" {
+		t.Fatal("bad limit error: ", err)
+	}
+
+	close(handler.release)
+	err = <-first
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	multiService.UpdateLimits(nil, nil)
+	err = <-dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiServiceMuxConnectionLimit(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK, uPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	handler := &limitHandler{
+		accepted: make(chan struct{}, 2),
+		release:  make(chan struct{}),
+	}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiService.SetMux(true)
+	multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	multiService.UpdateLimits([]string{"my user"}, []shadowaead_2022.UserLimit{{MaxConnections: 1}})
+	method2022, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := shadowsocks.NewMuxClient(method2022, func(ctx context.Context) (net.Conn, error) {
+		serverConn, clientConn := net.Pipe()
+		go multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+		return clientConn, nil
+	}, 0)
+	defer client.Close()
+
+	// the session is not counted, its first stream is
+	stream, err := client.DialContext(context.Background(), M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	<-handler.accepted
+	stream, err = client.DialContext(context.Background(), M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	_, err = stream.Read(make([]byte, 1))
+	var remoteErr *shadowmux.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != (&shadowaead_2022.LimitError{User: "my user", Cause: shadowaead_2022.ErrTooManyConnections}).Error() {
+		t.Fatal("expected connection limit, got ", err)
+	}
+	close(handler.release)
+}
+
+func TestMultiServiceUpdateLimits(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK, uPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	handler := &limitHandler{
+		accepted: make(chan struct{}, 2),
+		release:  make(chan struct{}),
+	}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateLimits([]string{"my user"}, nil)
+	if !errors.Is(err, shadowsocks.ErrListLengthMismatch) {
+		t.Fatal("expected list length mismatch, got ", err)
+	}
+	limits := []shadowaead_2022.UserLimit{{MaxConnections: 1}}
+	err = multiService.UpdateLimits([]string{"my user"}, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := limitDialer(t, method, multiService, iPSK[:], uPSK[:])
+
+	first := dial()
+	<-handler.accepted
+
+	// the user is added back while its connection is live
+	multiService.UpdateLimits(nil, nil)
+	multiService.UpdateLimits([]string{"my user"}, limits)
+	err = <-dial()
+	if !errors.Is(err, shadowaead_2022.ErrTooManyConnections) {
+		t.Fatal("expected connection limit, got ", err)
+	}
+
+	limits[0].MaxConnections = 2
+	multiService.UpdateLimits([]string{"my user"}, limits)
+	second := dial()
+	<-handler.accepted
+
+	close(handler.release)
+	for _, done := range []chan error{first, second} {
+		err = <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMultiServiceQuota(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK, uPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	handler := &copyHandler{done: make(chan copyResult, 1)}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	multiService.UpdateLimits([]string{"my user"}, []shadowaead_2022.UserLimit{{MaxBytes: 1024}})
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+	conn, err := client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		payload := make([]byte, 512)
+		for {
+			_, err := conn.Write(payload)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	result := <-handler.done
+	if !errors.Is(result.err, shadowaead_2022.ErrQuotaExceeded) {
+		t.Fatal("expected quota exceeded, got ", result.err)
+	}
+	if result.n < 1024 || result.n > 1024+shadowaead_2022.MaxPacketSize {
+		t.Fatal("bad bytes read before quota exceeded: ", result.n)
+	}
+}
+
+func TestMultiServiceQuotaPeriodClock(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK, uPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	clock := &stepClock{now: time.Now()}
+	handler := &relaySessionHandler{packets: make(chan string, 2)}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler, shadowaead_2022.ServiceWithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	multiService.UpdateLimits([]string{"my user"}, []shadowaead_2022.UserLimit{{MaxBytes: 1000, Period: time.Hour}})
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]}, shadowaead_2022.MethodWithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &packetRecorder{}
+	packetConn := client.DialPacketConn(recorder)
+	newPacket := func() error {
+		_, err := packetConn.WriteTo(make([]byte, 1000), M.ParseSocksaddr("1.1.1.1:53").UDPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return multiService.NewPacket(context.Background(), nil, buf.As(recorder.packets[len(recorder.packets)-1]), M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+	}
+	err = newPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newPacket()
+	if !errors.Is(err, shadowaead_2022.ErrQuotaExceeded) {
+		t.Fatal("expected quota exceeded, got ", err)
+	}
+	// the quota period follows the service clock
+	clock.Add(time.Hour)
+	err = newPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiServiceRateLimit(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK, uPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	const rate = 64 * 1024
+	handler := &copyHandler{done: make(chan copyResult, 1), limit: 2 * rate}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	multiService.UpdateLimits([]string{"my user"}, []shadowaead_2022.UserLimit{{BytesPerSecond: rate}})
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+	conn, err := client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	go conn.Write(make([]byte, 2*rate))
+	result := <-handler.done
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	// the bucket starts full, so the second half waits for refill
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatal("rate limit not applied, took ", elapsed)
+	}
+}
+
+func TestMultiServicePacketRateLimit(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK, uPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	handler := &relaySessionHandler{packets: make(chan string, 2)}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	multiService.UpdateLimits([]string{"my user"}, []shadowaead_2022.UserLimit{{BytesPerSecond: 512}})
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &packetRecorder{}
+	packetConn := client.DialPacketConn(recorder)
+	for i := 0; i < 2; i++ {
+		_, err = packetConn.WriteTo(make([]byte, 1000), M.ParseSocksaddr("1.1.1.1:53").UDPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = multiService.NewPacket(context.Background(), nil, buf.As(recorder.packets[i]), M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the packet larger than the rate passes the full bucket, the next one is dropped
+	select {
+	case <-handler.packets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet larger than the rate dropped")
+	}
+	select {
+	case <-handler.packets:
+		t.Fatal("rate limit not applied")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMultiServiceUDPSessionLimit(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK, uPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+	rand.Reader.Read(uPSK[:])
+
+	handler := &limitHandler{
+		accepted: make(chan struct{}, 2),
+		release:  make(chan struct{}),
+	}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiService.UpdateUsers([]string{"my user"}, [][]byte{uPSK[:]})
+	multiService.UpdateLimits([]string{"my user"}, []shadowaead_2022.UserLimit{{MaxUDPSessions: 1}})
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each packet conn of the client is a new session
+	newPacket := func() error {
+		recorder := &packetRecorder{}
+		_, err := client.DialPacketConn(recorder).WriteTo([]byte("ping"), M.ParseSocksaddr("1.1.1.1:53").UDPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := buf.NewPacket()
+		buffer.Write(recorder.packets[0])
+		err = multiService.NewPacket(context.Background(), nil, buffer, M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+		if err != nil {
+			buffer.Release()
+		}
+		return err
+	}
+
+	err = newPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handler.accepted
+	for i := 0; i < 3; i++ {
+		err = newPacket()
+		if !errors.Is(err, shadowaead_2022.ErrTooManyUDPSessions) {
+			t.Fatal("expected udp session limit, got ", err)
+		}
+	}
+
+	// the session is released once the handler returns
+	close(handler.release)
+	for i := 0; ; i++ {
+		err = newPacket()
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("udp session not released: ", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	<-handler.accepted
+}
+
+func limitDialer(t *testing.T, method string, multiService *shadowaead_2022.MultiService[string], iPSK []byte, uPSK []byte) func() chan error {
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK, uPSK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() chan error {
+		serverConn, clientConn := net.Pipe()
+		t.Cleanup(func() {
+			common.Close(serverConn, clientConn)
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+		}()
+		go client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+		return done
+	}
+}
+
+type packetRecorder struct {
+	net.Conn
+	packets [][]byte
+}
+
+func (c *packetRecorder) Write(p []byte) (int, error) {
+	c.packets = append(c.packets, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+type copyResult struct {
+	n   int
+	err error
+}
+
+// copyHandler reads a connection until an error, or until limit bytes if set.
+type copyHandler struct {
+	done  chan copyResult
+	limit int
+}
+
+func (h *copyHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	var result copyResult
+	buffer := make([]byte, 1024)
+	for h.limit == 0 || result.n < h.limit {
+		var n int
+		n, result.err = conn.Read(buffer)
+		result.n += n
+		if result.err != nil {
+			break
+		}
+	}
+	h.done <- result
+	return nil
+}
+
+func (h *copyHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *copyHandler) NewError(ctx context.Context, err error) {
+}
+
+type limitHandler struct {
+	accepted chan struct{}
+	release  chan struct{}
+}
+
+func (h *limitHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.accepted <- struct{}{}
+	<-h.release
+	return nil
+}
+
+func (h *limitHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.accepted <- struct{}{}
+	<-h.release
+	return nil
+}
+
+func (h *limitHandler) NewError(ctx context.Context, err error) {
+}
@@ -0,0 +1,219 @@
+package shadowaead_2022
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// PaddingPolicy decides the padding length of TCP request headers and UDP packets.
+// Server TCP response headers have no padding field in the protocol and are never padded.
+type PaddingPolicy interface {
+	// PaddingLength returns the padding length for a header of network to destination carrying
+	// payloadLen bytes of payload, results out of [0, MaxPaddingLength] are clamped, and UDP
+	// padding to the space left in a packet of MaxPacketSize.
+	// rng is the random source configured for the method or service, an error fails the write.
+	PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error)
+}
+
+// DefaultPaddingPolicy pads TCP requests with a short initial payload and DNS packets.
+var DefaultPaddingPolicy PaddingPolicy = defaultPaddingPolicy{}
+
+type defaultPaddingPolicy struct{}
+
+func (defaultPaddingPolicy) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	if payloadLen >= MaxPaddingLength {
+		return 0, nil
+	}
+	var maxPaddingLen int
+	if network == N.NetworkTCP {
+		maxPaddingLen = MaxPaddingLength
+	} else if destination.Port == 53 {
+		maxPaddingLen = MaxPaddingLength - payloadLen
+	} else {
+		return 0, nil
+	}
+	paddingLen, err := randomIntn(rng, maxPaddingLen)
+	if err != nil {
+		return 0, err
+	}
+	return paddingLen + 1, nil
+}
+
+// NoPadding disables padding, except for TCP requests without initial payload which
+// the protocol requires to carry at least one byte of padding.
+var NoPadding PaddingPolicy = noPadding{}
+
+type noPadding struct{}
+
+func (noPadding) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	return 0, nil
+}
+
+// UniformPadding pads every header with a length chosen uniformly from [Min, Max].
+type UniformPadding struct {
+	Min int
+	Max int
+}
+
+func (p UniformPadding) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	if p.Max <= p.Min {
+		return p.Min, nil
+	}
+	paddingLen, err := randomIntn(rng, p.Max-p.Min+1)
+	if err != nil {
+		return 0, err
+	}
+	return p.Min + paddingLen, nil
+}
+
+func (p UniformPadding) check() error {
+	if p.Min < 0 || p.Max < p.Min {
+		return E.Extend(ErrBadPaddingPolicy, "uniform padding range ", p.Min, "-", p.Max)
+	}
+	return nil
+}
+
+// BucketPadding pads the payload up to the smallest of Sizes that fits it,
+// payloads larger than every size are not padded. Sizes must be sorted in ascending order,
+// options with unsorted sizes are rejected with ErrBadPaddingPolicy.
+type BucketPadding struct {
+	Sizes []int
+}
+
+func (p BucketPadding) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	index := sort.SearchInts(p.Sizes, payloadLen)
+	if index == len(p.Sizes) {
+		return 0, nil
+	}
+	return p.Sizes[index] - payloadLen, nil
+}
+
+func (p BucketPadding) check() error {
+	if !sort.IntsAreSorted(p.Sizes) {
+		return E.Extend(ErrBadPaddingPolicy, "bucket padding sizes not sorted")
+	}
+	return nil
+}
+
+// HistogramPadding samples the padding length from Lengths, each chosen with
+// a probability proportional to the weight at the same index of Weights.
+// Lengths and Weights must have the same length.
+type HistogramPadding struct {
+	Lengths []int
+	Weights []uint32
+}
+
+func (p HistogramPadding) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	lengths := p.Lengths
+	if len(lengths) > len(p.Weights) {
+		lengths = lengths[:len(p.Weights)]
+	}
+	var total uint64
+	for i := range lengths {
+		total += uint64(p.Weights[i])
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	sample, err := randomUint64(rng)
+	if err != nil {
+		return 0, err
+	}
+	sample %= total
+	for i, length := range lengths {
+		weight := uint64(p.Weights[i])
+		if sample < weight {
+			return length, nil
+		}
+		sample -= weight
+	}
+	return 0, nil
+}
+
+func (p HistogramPadding) check() error {
+	if len(p.Lengths) != len(p.Weights) {
+		return E.Extend(ErrBadPaddingPolicy, "histogram padding has ", len(p.Lengths), " lengths and ", len(p.Weights), " weights")
+	}
+	return nil
+}
+
+// NetworkPadding uses TCP for TCP requests and UDP for UDP packets, nil disables padding of the network.
+type NetworkPadding struct {
+	TCP PaddingPolicy
+	UDP PaddingPolicy
+}
+
+func (p NetworkPadding) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	policy := p.UDP
+	if network == N.NetworkTCP {
+		policy = p.TCP
+	}
+	if policy == nil {
+		return 0, nil
+	}
+	return policy.PaddingLength(rng, network, destination, payloadLen)
+}
+
+func (p NetworkPadding) check() error {
+	err := checkPaddingPolicy(p.TCP)
+	if err != nil {
+		return err
+	}
+	return checkPaddingPolicy(p.UDP)
+}
+
+type paddingPolicyChecker interface {
+	check() error
+}
+
+// checkPaddingPolicy validates the parameters of built-in policies.
+func checkPaddingPolicy(policy PaddingPolicy) error {
+	if checker, isChecker := policy.(paddingPolicyChecker); isChecker {
+		return checker.check()
+	}
+	return nil
+}
+
+// paddingLength clamps the padding length returned by policy, overhead is the length of
+// a UDP packet besides its payload and padding.
+func paddingLength(policy PaddingPolicy, rng io.Reader, network string, destination M.Socksaddr, payloadLen int, overhead int) (int, error) {
+	paddingLen, err := policy.PaddingLength(rng, network, destination, payloadLen)
+	if err != nil {
+		return 0, E.Cause(err, "padding policy")
+	}
+	maxPaddingLen := MaxPaddingLength
+	if network == N.NetworkUDP && MaxPacketSize-overhead-payloadLen < maxPaddingLen {
+		maxPaddingLen = MaxPacketSize - overhead - payloadLen
+	}
+	if paddingLen > maxPaddingLen {
+		paddingLen = maxPaddingLen
+	}
+	if paddingLen < 0 {
+		paddingLen = 0
+	}
+	// a request header without payload must be padded
+	if network == N.NetworkTCP && payloadLen == 0 && paddingLen == 0 {
+		paddingLen = 1
+	}
+	return paddingLen, nil
+}
+
+func randomUint64(rng io.Reader) (uint64, error) {
+	var value uint64
+	err := binary.Read(rng, binary.BigEndian, &value)
+	return value, err
+}
+
+// randomIntn returns a number in [0, n), the modulo bias is negligible for padding lengths.
+func randomIntn(rng io.Reader, n int) (int, error) {
+	value, err := randomUint64(rng)
+	if err != nil {
+		return 0, err
+	}
+	return int(value % uint64(n)), nil
+}
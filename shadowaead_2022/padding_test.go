@@ -0,0 +1,210 @@
+package shadowaead_2022_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	t.Parallel()
+	bucket := shadowaead_2022.BucketPadding{Sizes: []int{128, 512}}
+	for payloadLen, expected := range map[int]int{0: 128, 100: 28, 128: 0, 200: 312, 600: 0} {
+		if paddingLen := paddingLength(t, bucket, N.NetworkTCP, payloadLen); paddingLen != expected {
+			t.Fatal("bucket padding of ", payloadLen, ": expected ", expected, ", got ", paddingLen)
+		}
+	}
+	histogram := shadowaead_2022.HistogramPadding{Lengths: []int{10, 20, 30}, Weights: []uint32{0, 1, 0}}
+	uniform := shadowaead_2022.UniformPadding{Min: 10, Max: 20}
+	for i := 0; i < 100; i++ {
+		if paddingLen := paddingLength(t, histogram, N.NetworkUDP, 0); paddingLen != 20 {
+			t.Fatal("histogram padding: expected 20, got ", paddingLen)
+		}
+		if paddingLen := paddingLength(t, uniform, N.NetworkUDP, 0); paddingLen < 10 || paddingLen > 20 {
+			t.Fatal("uniform padding out of range: ", paddingLen)
+		}
+	}
+	network := shadowaead_2022.NetworkPadding{UDP: shadowaead_2022.UniformPadding{Min: 5, Max: 5}}
+	if paddingLength(t, network, N.NetworkTCP, 0) != 0 || paddingLength(t, network, N.NetworkUDP, 0) != 5 {
+		t.Fatal("bad network padding")
+	}
+}
+
+func paddingLength(t *testing.T, policy shadowaead_2022.PaddingPolicy, network string, payloadLen int) int {
+	paddingLen, err := policy.PaddingLength(rand.Reader, network, M.ParseSocksaddr("test.com:443"), payloadLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paddingLen
+}
+
+func TestBadPaddingPolicies(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	for _, policy := range []shadowaead_2022.PaddingPolicy{
+		shadowaead_2022.UniformPadding{Min: 20, Max: 10},
+		shadowaead_2022.BucketPadding{Sizes: []int{512, 128}},
+		shadowaead_2022.HistogramPadding{Lengths: []int{10, 20}, Weights: []uint32{1}},
+		shadowaead_2022.NetworkPadding{UDP: shadowaead_2022.BucketPadding{Sizes: []int{512, 128}}},
+	} {
+		_, err := shadowaead_2022.New(method, [][]byte{psk[:]}, shadowaead_2022.MethodWithPaddingPolicy(policy))
+		if !errors.Is(err, shadowaead_2022.ErrBadPaddingPolicy) {
+			t.Fatal("method: expected bad padding policy, got ", err)
+		}
+		_, err = shadowaead_2022.NewService(method, psk[:], 500, nil, shadowaead_2022.ServiceWithPaddingPolicy(policy))
+		if !errors.Is(err, shadowaead_2022.ErrBadPaddingPolicy) {
+			t.Fatal("service: expected bad padding policy, got ", err)
+		}
+	}
+}
+
+func TestUDPPaddingLimit(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	overhead := 16 + 16 + 1 + 8 + 2 + 1 + 4 + 2
+	uniform := shadowaead_2022.UniformPadding{Min: shadowaead_2022.MaxPaddingLength, Max: shadowaead_2022.MaxPaddingLength}
+	bucket := shadowaead_2022.BucketPadding{Sizes: []int{1500}}
+	for _, testCase := range []struct {
+		policy     shadowaead_2022.PaddingPolicy
+		payloadLen int
+		paddingLen int
+	}{
+		{uniform, 100, shadowaead_2022.MaxPaddingLength},
+		{uniform, 1200, shadowaead_2022.MaxPaddingLength},
+		// the padding is limited by the space left under MaxPacketSize
+		{uniform, shadowaead_2022.MaxPacketSize - overhead - 100, 100},
+		{bucket, 1200, 300},
+	} {
+		client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, shadowaead_2022.MethodWithPaddingPolicy(testCase.policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := &writeRecorder{}
+		_, err = client.DialPacketConn(recorder).WriteTo(make([]byte, testCase.payloadLen), M.ParseSocksaddr("1.1.1.1:53").UDPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := testCase.payloadLen + testCase.paddingLen + overhead
+		if recorder.buffer.Len() != expected {
+			t.Fatal("payload of ", testCase.payloadLen, ": expected packet of ", expected, ", got ", recorder.buffer.Len())
+		}
+	}
+}
+
+func TestPaddingPolicyRandom(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	rng := &randomSource{Reader: rand.Reader}
+	policy := &randomRecorder{}
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, shadowaead_2022.MethodWithRandom(rng), shadowaead_2022.MethodWithPaddingPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DialEarlyConn(&writeRecorder{}, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.rng != rng {
+		t.Fatal("padding policy not called with the configured random source")
+	}
+}
+
+func TestPaddingPolicyRandomError(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, shadowaead_2022.MethodWithPaddingPolicy(failingRandomPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DialEarlyConn(&writeRecorder{}, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+	if !errors.Is(err, errRandom) {
+		t.Fatal("expected tcp write failed, got ", err)
+	}
+	_, err = client.DialPacketConn(&writeRecorder{}).WriteTo([]byte("hello"), M.ParseSocksaddr("1.1.1.1:53").UDPAddr())
+	if !errors.Is(err, errRandom) {
+		t.Fatal("expected udp write failed, got ", err)
+	}
+}
+
+var errRandom = errors.New("random source failed")
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errRandom
+}
+
+// failingRandomPolicy pads with a random source that always fails.
+type failingRandomPolicy struct{}
+
+func (failingRandomPolicy) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	return shadowaead_2022.UniformPadding{Min: 1, Max: 10}.PaddingLength(failingReader{}, network, destination, payloadLen)
+}
+
+type randomSource struct {
+	io.Reader
+}
+
+type randomRecorder struct {
+	rng io.Reader
+}
+
+func (r *randomRecorder) PaddingLength(rng io.Reader, network string, destination M.Socksaddr, payloadLen int) (int, error) {
+	r.rng = rng
+	return shadowaead_2022.UniformPadding{Min: 1, Max: 10}.PaddingLength(rng, network, destination, payloadLen)
+}
+
+func TestNoPaddingEmptyRequest(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, shadowaead_2022.MethodWithPaddingPolicy(shadowaead_2022.NoPadding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := &writeRecorder{}
+	_, err = client.DialConn(handshake, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &multiHandler{t, &wg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		clientConn.Write(handshake.buffer.Bytes())
+		clientConn.Close()
+	}()
+	err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	serverConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
@@ -9,8 +9,6 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"io"
-	"math"
-	mRand "math/rand"
 	"net"
 	"os"
 	"strings"
@@ -23,15 +21,24 @@ import (
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/random"
+	"github.com/sagernet/sing/common/replay"
 	"github.com/sagernet/sing/common/rw"
 
 	"github.com/zeebo/blake3"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// SIP022 only defines extended identity headers for the AES methods. The ChaCha methods
+// carry them as well, a 16 byte header following the salt of a TCP request or the
+// PacketNonceSize bytes nonce of a UDP packet:
+//
+//	salt or nonce | BLAKE3(next PSK)[:16] XOR XChaCha20(IdentitySubkey(PSK, salt or nonce), zero nonce) | ...
+//
+// Relays strip one header per PSK and forward the rest unchanged.
 const (
 	HeaderTypeClient              = 0
 	HeaderTypeServer              = 1
@@ -51,9 +58,56 @@ var (
 	ErrBadClientSessionId    = E.New("bad client session id")
 	ErrPacketIdNotUnique     = E.New("packet id not unique")
 	ErrTooManyServerSessions = E.New("server session changed more than once during the last minute")
+	ErrServerSessionReplay   = E.New("server session id not unique")
 	ErrPacketTooShort        = E.New("packet too short")
+	ErrEvictedSession        = E.New("udp session evicted from the session cache")
+	ErrUnknownIdentity       = E.New("invalid request: unknown identity")
+	ErrBadMaxPacketSize      = E.New("bad max packet size")
+	ErrBadTimestampTolerance = E.New("bad timestamp tolerance")
+	ErrMissingClock          = E.New("missing clock")
+	ErrMissingRandom         = E.New("missing random source")
+	ErrMissingPaddingPolicy  = E.New("missing padding policy")
+	ErrBadPaddingPolicy      = E.New("bad padding policy")
 )
 
+// TimestampError is returned for a request or response with a timestamp out of the allowed range.
+type TimestampError struct {
+	Epoch uint64
+	// Diff is the remote time minus local time.
+	Diff      time.Duration
+	Tolerance time.Duration
+}
+
+func (e *TimestampError) Unwrap() error {
+	return ErrBadTimestamp
+}
+
+func (e *TimestampError) Error() string {
+	return F.ToString(ErrBadTimestamp.Error(), ": received ", e.Epoch, ", diff ", e.Diff, " exceeds ", e.Tolerance)
+}
+
+func checkTimestamp(now time.Time, epoch uint64, tolerance time.Duration) error {
+	diff := time.Duration(int64(epoch)-now.Unix()) * time.Second
+	if diff > tolerance || diff < -tolerance {
+		return &TimestampError{epoch, diff, tolerance}
+	}
+	return nil
+}
+
+// PacketIDError is returned for a packet rejected by the sliding window of its session.
+type PacketIDError struct {
+	SessionID uint64
+	PacketID  uint64
+}
+
+func (e *PacketIDError) Unwrap() error {
+	return ErrPacketIdNotUnique
+}
+
+func (e *PacketIDError) Error() string {
+	return F.ToString(ErrPacketIdNotUnique.Error(), ": session ", e.SessionID, ", packet ", e.PacketID)
+}
+
 var List = []string{
 	"2022-blake3-aes-128-gcm",
 	"2022-blake3-aes-256-gcm",
@@ -83,7 +137,12 @@ func NewWithPassword(method string, password string, options ...MethodOption) (s
 
 func New(method string, pskList [][]byte, options ...MethodOption) (shadowsocks.Method, error) {
 	m := &Method{
-		name: method,
+		name:               method,
+		clock:              systemClock{},
+		timestampTolerance: DefaultTimestampTolerance,
+		paddingPolicy:      DefaultPaddingPolicy,
+		rng:                rand.Reader,
+		maxPacketSize:      MaxPacketSize,
 	}
 
 	switch method {
@@ -96,11 +155,10 @@ func New(method string, pskList [][]byte, options ...MethodOption) (shadowsocks.
 		m.constructor = aeadCipher(aes.NewCipher, cipher.NewGCM)
 		m.blockConstructor = aes.NewCipher
 	case "2022-blake3-chacha20-poly1305":
-		if len(pskList) > 1 {
-			return nil, os.ErrInvalid
-		}
 		m.keySaltLength = 32
 		m.constructor = chacha20poly1305.New
+	default:
+		return nil, os.ErrInvalid
 	}
 
 	if len(pskList) == 0 {
@@ -139,7 +197,7 @@ func New(method string, pskList [][]byte, options ...MethodOption) (shadowsocks.
 			return nil, err
 		}
 	case "2022-blake3-chacha20-poly1305":
-		m.udpCipher, err = chacha20poly1305.NewX(pskList[0])
+		m.udpCipher, err = chacha20poly1305.NewX(pskList[len(pskList)-1])
 		if err != nil {
 			return nil, err
 		}
@@ -149,6 +207,10 @@ func New(method string, pskList [][]byte, options ...MethodOption) (shadowsocks.
 	for _, option := range options {
 		option(m)
 	}
+	err = checkOptions(m.clock, m.timestampTolerance, m.paddingPolicy, m.rng, m.maxPacketSize)
+	if err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
@@ -186,6 +248,12 @@ type Method struct {
 	udpBlockDecryptCipher cipher.Block
 	pskList               [][]byte
 	pskHash               []byte
+	clock                 Clock
+	timestampTolerance    time.Duration
+	paddingPolicy         PaddingPolicy
+	rng                   io.Reader
+	maxPacketSize         int
+	replayFilter          replay.Filter
 }
 
 func (m *Method) Name() string {
@@ -228,24 +296,14 @@ func (m *Method) writeExtendedIdentityHeaders(request *buf.Buffer, salt []byte)
 		return nil
 	}
 	for i, psk := range m.pskList {
-		keyMaterial := buf.Make(m.keySaltLength * 2)
-		copy(keyMaterial, psk)
-		copy(keyMaterial[m.keySaltLength:], salt)
-		_identitySubkey := buf.StackNewSize(m.keySaltLength)
-		identitySubkey := common.Dup(_identitySubkey)
-		identitySubkey.Extend(identitySubkey.FreeLen())
-		blake3.DeriveKey("shadowsocks 2022 identity subkey", keyMaterial, identitySubkey.Bytes())
-
+		identitySubkey := IdentitySubkey(psk, salt, m.keySaltLength)
 		pskHash := m.pskHash[aes.BlockSize*i : aes.BlockSize*(i+1)]
 
 		header := request.Extend(16)
-		b, err := m.blockConstructor(identitySubkey.Bytes())
+		err := encryptIdentityHeader(m.blockConstructor, identitySubkey, header, pskHash)
 		if err != nil {
 			return err
 		}
-		b.Encrypt(header, pskHash)
-		identitySubkey.Release()
-		common.KeepAlive(_identitySubkey)
 		if i == pskLen-2 {
 			break
 		}
@@ -255,7 +313,7 @@ func (m *Method) writeExtendedIdentityHeaders(request *buf.Buffer, salt []byte)
 
 func (c *clientConn) writeRequest(payload []byte) error {
 	salt := make([]byte, c.keySaltLength)
-	common.Must1(io.ReadFull(rand.Reader, salt))
+	common.Must1(io.ReadFull(c.rng, salt))
 
 	key := SessionKey(c.pskList[len(c.pskList)-1], salt, c.keySaltLength)
 	writeCipher, err := c.constructor(common.Dup(key))
@@ -265,7 +323,7 @@ func (c *clientConn) writeRequest(payload []byte) error {
 	writer := shadowaead.NewWriter(
 		c.Conn,
 		writeCipher,
-		MaxPacketSize,
+		c.maxPacketSize,
 	)
 	common.KeepAlive(key)
 
@@ -280,10 +338,10 @@ func (c *clientConn) writeRequest(payload []byte) error {
 	var _fixedLengthBuffer [RequestHeaderFixedChunkLength]byte
 	fixedLengthBuffer := buf.With(common.Dup(_fixedLengthBuffer[:]))
 	common.Must(fixedLengthBuffer.WriteByte(HeaderTypeClient))
-	common.Must(binary.Write(fixedLengthBuffer, binary.BigEndian, uint64(time.Now().Unix())))
-	var paddingLen int
-	if len(payload) < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength) + 1
+	common.Must(binary.Write(fixedLengthBuffer, binary.BigEndian, uint64(c.clock.Now().Unix())))
+	paddingLen, err := paddingLength(c.paddingPolicy, c.rng, N.NetworkTCP, c.destination, len(payload), 0)
+	if err != nil {
+		return err
 	}
 	variableLengthHeaderLen := M.SocksaddrSerializer.AddrPortLen(c.destination) + 2 + paddingLen
 	payloadLen := len(payload)
@@ -332,6 +390,10 @@ func (c *clientConn) readResponse() error {
 		return err
 	}
 
+	var responseSalt []byte
+	if c.replayFilter != nil {
+		responseSalt = append(responseSalt, salt.Bytes()...)
+	}
 	key := SessionKey(c.pskList[len(c.pskList)-1], salt.Bytes(), c.keySaltLength)
 	salt.Release()
 	common.KeepAlive(_salt)
@@ -366,9 +428,9 @@ func (c *clientConn) readResponse() error {
 		return err
 	}
 
-	diff := int(math.Abs(float64(time.Now().Unix() - int64(epoch))))
-	if diff > 30 {
-		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = checkTimestamp(c.clock.Now(), epoch, c.timestampTolerance)
+	if err != nil {
+		return err
 	}
 
 	_requestSalt := buf.StackNewSize(c.keySaltLength)
@@ -378,13 +440,17 @@ func (c *clientConn) readResponse() error {
 		return err
 	}
 
-	if bytes.Compare(requestSalt.Bytes(), c.requestSalt) > 0 {
+	if !bytes.Equal(requestSalt.Bytes(), c.requestSalt) {
 		return ErrBadRequestSalt
 	}
 	requestSalt.Release()
 	common.KeepAlive(_requestSalt)
 	c.requestSalt = nil
 
+	if responseSalt != nil && !c.replayFilter.Check(responseSalt) {
+		return ErrSaltNotUnique
+	}
+
 	var length uint16
 	err = binary.Read(reader, binary.BigEndian, &length)
 	if err != nil {
@@ -473,30 +539,30 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 		hdrLen = PacketNonceSize
 	}
 
-	var paddingLen int
-	if destination.Port == 53 && buffer.Len() < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength-buffer.Len()) + 1
-	}
-
 	hdrLen += 16 // packet header
 	pskLen := len(c.pskList)
-	if c.udpCipher == nil && pskLen > 1 {
+	if pskLen > 1 {
 		hdrLen += (pskLen - 1) * aes.BlockSize
 	}
 	hdrLen += 1 // header type
 	hdrLen += 8 // timestamp
 	hdrLen += 2 // padding length
-	hdrLen += paddingLen
 	hdrLen += M.SocksaddrSerializer.AddrPortLen(destination)
+	paddingLen, err := paddingLength(c.paddingPolicy, c.rng, N.NetworkUDP, destination, buffer.Len(), hdrLen+shadowaead.Overhead)
+	if err != nil {
+		return err
+	}
+	hdrLen += paddingLen
 	header := buf.With(buffer.ExtendHeader(hdrLen))
 
 	var dataIndex int
 	if c.udpCipher != nil {
 		common.Must1(header.ReadFullFrom(c.session.rng, PacketNonceSize))
-		if pskLen > 1 {
-			panic("unsupported chacha extended header")
+		err := c.writePacketIdentityHeaders(header)
+		if err != nil {
+			return err
 		}
-		dataIndex = PacketNonceSize
+		dataIndex = header.Len()
 	} else {
 		dataIndex = aes.BlockSize
 	}
@@ -526,7 +592,7 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 	}
 	common.Must(
 		header.WriteByte(HeaderTypeClient),
-		binary.Write(header, binary.BigEndian, uint64(time.Now().Unix())),
+		binary.Write(header, binary.BigEndian, uint64(c.clock.Now().Unix())),
 		binary.Write(header, binary.BigEndian, uint16(paddingLen)), // padding length
 	)
 
@@ -534,12 +600,12 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 		header.Extend(paddingLen)
 	}
 
-	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
+	err = M.SocksaddrSerializer.WriteAddrPort(header, destination)
 	if err != nil {
 		return err
 	}
 	if c.udpCipher != nil {
-		c.udpCipher.Seal(buffer.Index(dataIndex), buffer.To(dataIndex), buffer.From(dataIndex), nil)
+		c.udpCipher.Seal(buffer.Index(dataIndex), buffer.To(PacketNonceSize), buffer.From(dataIndex), nil)
 		buffer.Extend(shadowaead.Overhead)
 	} else {
 		packetHeader := buffer.To(aes.BlockSize)
@@ -550,6 +616,25 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 	return common.Error(c.Write(buffer.Bytes()))
 }
 
+// writePacketIdentityHeaders writes extended identity headers of ChaCha packets,
+// keyed by each psk and the packet nonce.
+func (c *clientPacketConn) writePacketIdentityHeaders(header *buf.Buffer) error {
+	pskLen := len(c.pskList)
+	if pskLen < 2 {
+		return nil
+	}
+	nonce := header.To(PacketNonceSize)
+	for i, psk := range c.pskList[:pskLen-1] {
+		identitySubkey := IdentitySubkey(psk, nonce, c.keySaltLength)
+		pskHash := c.pskHash[aes.BlockSize*i : aes.BlockSize*(i+1)]
+		err := xorIdentityHeader(identitySubkey, header.Extend(aes.BlockSize), pskHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 	n, err := c.Read(buffer.FreeBytes())
 	if err != nil {
@@ -588,11 +673,11 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 
 	if sessionId == c.session.remoteSessionId {
 		if !c.session.window.Check(packetId) {
-			return M.Socksaddr{}, ErrPacketIdNotUnique
+			return M.Socksaddr{}, &PacketIDError{sessionId, packetId}
 		}
 	} else if sessionId == c.session.lastRemoteSessionId {
 		if !c.session.lastWindow.Check(packetId) {
-			return M.Socksaddr{}, ErrPacketIdNotUnique
+			return M.Socksaddr{}, &PacketIDError{sessionId, packetId}
 		}
 	}
 
@@ -632,28 +717,34 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 		return M.Socksaddr{}, err
 	}
 
-	diff := int(math.Abs(float64(time.Now().Unix() - int64(epoch))))
-	if diff > 30 {
-		return M.Socksaddr{}, E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = checkTimestamp(c.clock.Now(), epoch, c.timestampTolerance)
+	if err != nil {
+		return M.Socksaddr{}, err
 	}
 
 	if sessionId == c.session.remoteSessionId {
 		c.session.window.Add(packetId)
 	} else if sessionId == c.session.lastRemoteSessionId {
 		c.session.lastWindow.Add(packetId)
-		c.session.lastRemoteSeen = time.Now().Unix()
+		c.session.lastRemoteSeen = c.clock.Now().Unix()
 	} else {
-		if c.session.remoteSessionId != 0 {
-			if time.Now().Unix()-c.session.lastRemoteSeen < 60 {
-				return M.Socksaddr{}, ErrTooManyServerSessions
-			} else {
-				c.session.lastRemoteSessionId = c.session.remoteSessionId
-				c.session.lastWindow = c.session.window
-				c.session.lastRemoteSeen = time.Now().Unix()
-				c.session.lastRemoteCipher = c.session.remoteCipher
-				c.session.window = SlidingWindow{}
+		if c.session.remoteSessionId != 0 && c.clock.Now().Unix()-c.session.lastRemoteSeen < 60 {
+			return M.Socksaddr{}, ErrTooManyServerSessions
+		}
+		if c.replayFilter != nil {
+			var sessionIdBytes [8]byte
+			binary.BigEndian.PutUint64(sessionIdBytes[:], sessionId)
+			if !c.replayFilter.Check(sessionIdBytes[:]) {
+				return M.Socksaddr{}, ErrServerSessionReplay
 			}
 		}
+		if c.session.remoteSessionId != 0 {
+			c.session.lastRemoteSessionId = c.session.remoteSessionId
+			c.session.lastWindow = c.session.window
+			c.session.lastRemoteSeen = c.clock.Now().Unix()
+			c.session.lastRemoteCipher = c.session.remoteCipher
+			c.session.window = SlidingWindow{}
+		}
 		c.session.remoteSessionId = sessionId
 		c.session.remoteCipher = remoteCipher
 		c.session.window.Add(packetId)
@@ -704,18 +795,18 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 	overHead += 16 // packet header
 	pskLen := len(c.pskList)
-	if c.udpCipher == nil && pskLen > 1 {
+	if pskLen > 1 {
 		overHead += (pskLen - 1) * aes.BlockSize
 	}
-	var paddingLen int
-	if destination.Port == 53 && len(p) < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength-len(p)) + 1
-	}
 	overHead += 1 // header type
 	overHead += 8 // timestamp
 	overHead += 2 // padding length
-	overHead += paddingLen
 	overHead += M.SocksaddrSerializer.AddrPortLen(destination)
+	paddingLen, err := paddingLength(c.paddingPolicy, c.rng, N.NetworkUDP, destination, len(p), overHead)
+	if err != nil {
+		return
+	}
+	overHead += paddingLen
 
 	_buffer := buf.StackNewSize(overHead + len(p))
 	defer common.KeepAlive(_buffer)
@@ -725,10 +816,11 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	var dataIndex int
 	if c.udpCipher != nil {
 		common.Must1(buffer.ReadFullFrom(c.session.rng, PacketNonceSize))
-		if pskLen > 1 {
-			panic("unsupported chacha extended header")
+		err = c.writePacketIdentityHeaders(buffer)
+		if err != nil {
+			return
 		}
-		dataIndex = PacketNonceSize
+		dataIndex = buffer.Len()
 	} else {
 		dataIndex = aes.BlockSize
 	}
@@ -758,7 +850,7 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 	common.Must(
 		buffer.WriteByte(HeaderTypeClient),
-		binary.Write(buffer, binary.BigEndian, uint64(time.Now().Unix())),
+		binary.Write(buffer, binary.BigEndian, uint64(c.clock.Now().Unix())),
 		binary.Write(buffer, binary.BigEndian, uint16(paddingLen)), // padding length
 	)
 
@@ -772,7 +864,7 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 	common.Must1(buffer.Write(p))
 	if c.udpCipher != nil {
-		c.udpCipher.Seal(buffer.Index(dataIndex), buffer.To(dataIndex), buffer.From(dataIndex), nil)
+		c.udpCipher.Seal(buffer.Index(dataIndex), buffer.To(PacketNonceSize), buffer.From(dataIndex), nil)
 		buffer.Extend(shadowaead.Overhead)
 	} else {
 		packetHeader := buffer.To(aes.BlockSize)
@@ -796,7 +888,7 @@ func (c *clientPacketConn) FrontHeadroom() int {
 	}
 	overHead += 16 // packet header
 	pskLen := len(c.pskList)
-	if c.udpCipher == nil && pskLen > 1 {
+	if pskLen > 1 {
 		overHead += (pskLen - 1) * aes.BlockSize
 	}
 	overHead += 1 // header type
@@ -832,10 +924,10 @@ func (s *udpSession) nextPacketId() uint64 {
 func (m *Method) newUDPSession() *udpSession {
 	session := &udpSession{}
 	if m.udpCipher != nil {
-		session.rng = Blake3KeyedHash(rand.Reader)
+		session.rng = Blake3KeyedHash(m.rng)
 		common.Must(binary.Read(session.rng, binary.BigEndian, &session.sessionId))
 	} else {
-		common.Must(binary.Read(rand.Reader, binary.BigEndian, &session.sessionId))
+		common.Must(binary.Read(m.rng, binary.BigEndian, &session.sessionId))
 	}
 	session.packetId--
 	if m.udpCipher == nil {
@@ -1,3 +1,182 @@
 package shadowaead_2022
 
+import (
+	"crypto/rand"
+	"io"
+	"time"
+
+	"github.com/sagernet/sing/common/replay"
+)
+
+// DefaultTimestampTolerance is the maximum allowed difference between the timestamp of a header and local time.
+const DefaultTimestampTolerance = 30 * time.Second
+
+// Clock is the source of time used to write and check header timestamps.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
 type MethodOption func(*Method)
+
+// MethodWithClock sets the clock used by the client, the system clock is used by default.
+func MethodWithClock(clock Clock) MethodOption {
+	return func(m *Method) {
+		m.clock = clock
+	}
+}
+
+// MethodWithTimestampTolerance sets the maximum allowed skew of server timestamps.
+func MethodWithTimestampTolerance(tolerance time.Duration) MethodOption {
+	return func(m *Method) {
+		m.timestampTolerance = tolerance
+	}
+}
+
+// MethodWithPaddingPolicy sets the padding of requests and UDP packets, DefaultPaddingPolicy is used by default.
+func MethodWithPaddingPolicy(policy PaddingPolicy) MethodOption {
+	return func(m *Method) {
+		m.paddingPolicy = policy
+	}
+}
+
+// MethodWithRandom sets the source of salts and UDP session ids, crypto/rand is used by default.
+func MethodWithRandom(rng io.Reader) MethodOption {
+	return func(m *Method) {
+		m.rng = rng
+	}
+}
+
+// MethodWithMaxPacketSize sets the maximum payload length of written TCP chunks, up to MaxPacketSize.
+func MethodWithMaxPacketSize(size int) MethodOption {
+	return func(m *Method) {
+		m.maxPacketSize = size
+	}
+}
+
+// MethodWithReplayFilter rejects server salts and UDP session ids already seen by filter,
+// so old server responses can not be replayed to the client. It is disabled by default.
+func MethodWithReplayFilter(filter replay.Filter) MethodOption {
+	return func(m *Method) {
+		m.replayFilter = filter
+	}
+}
+
+func checkOptions(clock Clock, timestampTolerance time.Duration, paddingPolicy PaddingPolicy, rng io.Reader, maxPacketSize int) error {
+	switch {
+	case clock == nil:
+		return ErrMissingClock
+	case timestampTolerance < 0:
+		return ErrBadTimestampTolerance
+	case paddingPolicy == nil:
+		return ErrMissingPaddingPolicy
+	case rng == nil:
+		return ErrMissingRandom
+	case maxPacketSize <= 0 || maxPacketSize > MaxPacketSize:
+		return ErrBadMaxPacketSize
+	}
+	return checkPaddingPolicy(paddingPolicy)
+}
+
+type ServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	clock               Clock
+	timestampTolerance  time.Duration
+	paddingPolicy       PaddingPolicy
+	replayFilter        replay.Filter
+	udpSessionCacheSize int
+	rng                 io.Reader
+	maxPacketSize       int
+}
+
+func newServiceOptions(options []ServiceOption) (serviceOptions, error) {
+	o := serviceOptions{
+		clock:              systemClock{},
+		timestampTolerance: DefaultTimestampTolerance,
+		paddingPolicy:      DefaultPaddingPolicy,
+		rng:                rand.Reader,
+		maxPacketSize:      MaxPacketSize,
+	}
+	for _, option := range options {
+		option(&o)
+	}
+	err := checkOptions(o.clock, o.timestampTolerance, o.paddingPolicy, o.rng, o.maxPacketSize)
+	if err != nil {
+		return o, err
+	}
+	if o.replayFilter == nil {
+		o.replayFilter = newSaltFilter(o.clock, o.timestampTolerance)
+	}
+	return o, nil
+}
+
+// ServiceWithClock sets the clock used by the service, the system clock is used by default.
+func ServiceWithClock(clock Clock) ServiceOption {
+	return func(o *serviceOptions) {
+		o.clock = clock
+	}
+}
+
+// ServiceWithTimestampTolerance sets the maximum allowed skew of client timestamps.
+func ServiceWithTimestampTolerance(tolerance time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		o.timestampTolerance = tolerance
+	}
+}
+
+// ServiceWithPaddingPolicy sets the padding of UDP packets, DefaultPaddingPolicy is used by default.
+func ServiceWithPaddingPolicy(policy PaddingPolicy) ServiceOption {
+	return func(o *serviceOptions) {
+		o.paddingPolicy = policy
+	}
+}
+
+// ServiceWithReplayFilter sets the filter of request salts. By default salts are kept in memory for
+// twice the timestamp tolerance, at least 60 seconds, a shared filter should keep them as long.
+func ServiceWithReplayFilter(filter replay.Filter) ServiceOption {
+	return func(o *serviceOptions) {
+		o.replayFilter = filter
+	}
+}
+
+// ServiceWithUDPSessionCacheSize limits the number of cached UDP sessions, the least recently used
+// ones are evicted first. Zero means unlimited, which is the default. Packets of an evicted session
+// are rejected with ErrEvictedSession until its UDP NAT entry expires, as its packet ids are lost.
+func ServiceWithUDPSessionCacheSize(size int) ServiceOption {
+	return func(o *serviceOptions) {
+		o.udpSessionCacheSize = size
+	}
+}
+
+// ServiceWithRandom sets the source of salts and UDP session ids, crypto/rand is used by default.
+func ServiceWithRandom(rng io.Reader) ServiceOption {
+	return func(o *serviceOptions) {
+		o.rng = rng
+	}
+}
+
+// ServiceWithMaxPacketSize sets the maximum payload length of written TCP chunks, up to MaxPacketSize.
+func ServiceWithMaxPacketSize(size int) ServiceOption {
+	return func(o *serviceOptions) {
+		o.maxPacketSize = size
+	}
+}
+
+type RelayOption func(*relayOptions)
+
+type relayOptions struct {
+	replayFilter replay.Filter
+}
+
+// RelayWithReplayFilter sets the filter of request salts, see ServiceWithReplayFilter.
+func RelayWithReplayFilter(filter replay.Filter) RelayOption {
+	return func(o *relayOptions) {
+		o.replayFilter = filter
+	}
+}
@@ -0,0 +1,108 @@
+package shadowaead_2022_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/replay"
+)
+
+func TestClientReplayFilter(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &responseHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a constant random source repeats the request salt, so a recorded response matches the next request
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]},
+		shadowaead_2022.MethodWithRandom(zeroReader{}),
+		shadowaead_2022.MethodWithReplayFilter(replay.NewSimple(time.Minute)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	recorder := &readRecorder{Conn: clientConn}
+	conn := client.DialEarlyConn(recorder, M.ParseSocksaddr("test.com:443"))
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	conn = client.DialEarlyConn(&replayConn{reader: bytes.NewReader(recorder.buffer.Bytes())}, M.ParseSocksaddr("test.com:443"))
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	if !errors.Is(err, shadowaead_2022.ErrSaltNotUnique) {
+		t.Fatal("expected replayed response rejected, got ", err)
+	}
+}
+
+type responseHandler struct{}
+
+func (h *responseHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := conn.Write([]byte("world"))
+	return err
+}
+
+func (h *responseHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *responseHandler) NewError(ctx context.Context, err error) {
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+type readRecorder struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (c *readRecorder) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buffer.Write(p[:n])
+	return n, err
+}
+
+type replayConn struct {
+	net.Conn
+	reader *bytes.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -18,12 +18,14 @@ import (
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/replay"
 	"github.com/sagernet/sing/common/udpnat"
 
 	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-var _ shadowsocks.Service = (*RelayService[int])(nil)
+var _ shadowsocks.ShutdownService = (*RelayService[int])(nil)
 
 type RelayService[U comparable] struct {
 	name          string
@@ -38,7 +40,15 @@ type RelayService[U comparable] struct {
 	uPSKHash     map[[aes.BlockSize]byte]U
 	uDestination map[U]M.Socksaddr
 	uCipher      map[U]cipher.Block
+	uUDPCipher   map[U]cipher.AEAD
 	udpNat       *udpnat.Service[uint64]
+	tracker      *shadowsocks.TrafficTracker[U]
+	replayFilter replay.Filter
+
+	failurePolicy shadowsocks.FailurePolicy
+	registry      *shadowsocks.Registry
+	events        shadowsocks.EventHandler
+	shutdown      shadowsocks.ShutdownGroup
 }
 
 func (s *RelayService[U]) Name() string {
@@ -49,10 +59,29 @@ func (s *RelayService[U]) Password() string {
 	return base64.StdEncoding.EncodeToString(s.iPSK)
 }
 
+// SetTrafficTracker enables per-user traffic accounting, nil disables it.
+func (s *RelayService[U]) SetTrafficTracker(tracker *shadowsocks.TrafficTracker[U]) {
+	s.tracker = tracker
+}
+
+// SetFailurePolicy sets how connections that fail the handshake are handled, nil resets them.
+func (s *RelayService[U]) SetFailurePolicy(policy shadowsocks.FailurePolicy) {
+	s.failurePolicy = policy
+}
+
+// SetRegistry enables tracking of live connections and UDP sessions, nil disables it.
+func (s *RelayService[U]) SetRegistry(registry *shadowsocks.Registry) {
+	s.registry = registry
+}
+
 func (s *RelayService[U]) UpdateUsers(userList []U, keyList [][]byte, destinationList []M.Socksaddr) error {
+	if len(userList) != len(keyList) || len(userList) != len(destinationList) {
+		return shadowsocks.ErrListLengthMismatch
+	}
 	uPSKHash := make(map[[aes.BlockSize]byte]U)
 	uDestination := make(map[U]M.Socksaddr)
 	uCipher := make(map[U]cipher.Block)
+	uUDPCipher := make(map[U]cipher.AEAD)
 	for i, user := range userList {
 		key := keyList[i]
 		destination := destinationList[i]
@@ -68,16 +97,25 @@ func (s *RelayService[U]) UpdateUsers(userList []U, keyList [][]byte, destinatio
 
 		uPSKHash[hash] = user
 		uDestination[user] = destination
-		var err error
-		uCipher[user], err = s.blockConstructor(key)
-		if err != nil {
-			return err
+		if s.blockConstructor != nil {
+			var err error
+			uCipher[user], err = s.blockConstructor(key)
+			if err != nil {
+				return err
+			}
+		} else {
+			var err error
+			uUDPCipher[user], err = chacha20poly1305.NewX(key)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	s.uPSKHash = uPSKHash
 	s.uDestination = uDestination
 	s.uCipher = uCipher
+	s.uUDPCipher = uUDPCipher
 	return nil
 }
 
@@ -96,7 +134,7 @@ func (s *RelayService[U]) UpdateUsersWithPasswords(userList []U, passwordList []
 	return s.UpdateUsers(userList, keyList, destinationList)
 }
 
-func NewRelayServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler) (*RelayService[U], error) {
+func NewRelayServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler, options ...RelayOption) (*RelayService[U], error) {
 	if password == "" {
 		return nil, ErrMissingPSK
 	}
@@ -104,10 +142,17 @@ func NewRelayServiceWithPassword[U comparable](method string, password string, u
 	if err != nil {
 		return nil, E.Cause(err, "decode psk")
 	}
-	return NewRelayService[U](method, iPSK, udpTimeout, handler)
+	return NewRelayService[U](method, iPSK, udpTimeout, handler, options...)
 }
 
-func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler) (*RelayService[U], error) {
+func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler, options ...RelayOption) (*RelayService[U], error) {
+	var o relayOptions
+	for _, option := range options {
+		option(&o)
+	}
+	if o.replayFilter == nil {
+		o.replayFilter = newSaltFilter(systemClock{}, DefaultTimestampTolerance)
+	}
 	s := &RelayService[U]{
 		name:    method,
 		handler: handler,
@@ -115,8 +160,10 @@ func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64,
 		uPSKHash:     make(map[[aes.BlockSize]byte]U),
 		uDestination: make(map[U]M.Socksaddr),
 		uCipher:      make(map[U]cipher.Block),
+		uUDPCipher:   make(map[U]cipher.AEAD),
 
-		udpNat: udpnat.New[uint64](udpTimeout, handler),
+		udpNat:       udpnat.New[uint64](udpTimeout, handler),
+		replayFilter: o.replayFilter,
 	}
 
 	switch method {
@@ -128,6 +175,9 @@ func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64,
 		s.keySaltLength = 32
 		s.constructor = aeadCipher(aes.NewCipher, cipher.NewGCM)
 		s.blockConstructor = aes.NewCipher
+	case "2022-blake3-chacha20-poly1305":
+		s.keySaltLength = 32
+		s.constructor = chacha20poly1305.New
 	default:
 		return nil, os.ErrInvalid
 	}
@@ -139,15 +189,33 @@ func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64,
 		}
 	}
 	s.iPSK = psk
+	if s.blockConstructor == nil {
+		return s, nil
+	}
 	var err error
 	s.udpBlockCipher, err = s.blockConstructor(psk)
 	return s, err
 }
 
+// SetEventHandler sets the handler of structured events, nil disables them.
+func (s *RelayService[U]) SetEventHandler(handler shadowsocks.EventHandler) {
+	s.events = handler
+}
+
 func (s *RelayService[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	return s.serveConnection(ctx, conn, metadata, s.newConnection)
+}
+
+func (s *RelayService[U]) serveConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, serve func(ctx context.Context, conn net.Conn, metadata M.Metadata) error) error {
+	var err error
+	if s.shutdown.AcquireConn(conn) {
+		err = shadowsocks.ServeConnection(ctx, conn, metadata, s.failurePolicy, serve)
+		s.shutdown.ReleaseConn(conn)
+	} else {
+		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: shadowsocks.ErrServiceClosed, Handshake: true}
+	}
+	if s.events != nil && shadowsocks.IsHandshakeError(err) {
+		reportError(ctx, s.events, s.name, N.NetworkTCP, metadata, err)
 	}
 	return err
 }
@@ -164,30 +232,24 @@ func (s *RelayService[U]) newConnection(ctx context.Context, conn net.Conn, meta
 		return shadowaead.ErrBadHeader
 	}
 	requestSalt := requestHeader.To(s.keySaltLength)
+	if !s.replayFilter.Check(requestSalt) {
+		return ErrSaltNotUnique
+	}
 	var _eiHeader [aes.BlockSize]byte
 	eiHeader := common.Dup(_eiHeader[:])
 	copy(eiHeader, requestHeader.Range(s.keySaltLength, s.keySaltLength+aes.BlockSize))
 
-	keyMaterial := buf.Make(s.keySaltLength * 2)
-	copy(keyMaterial, s.iPSK)
-	copy(keyMaterial[s.keySaltLength:], requestSalt)
-	_identitySubkey := buf.StackNewSize(s.keySaltLength)
-	identitySubkey := common.Dup(_identitySubkey)
-	identitySubkey.Extend(identitySubkey.FreeLen())
-	blake3.DeriveKey("shadowsocks 2022 identity subkey", keyMaterial, identitySubkey.Bytes())
-	b, err := s.blockConstructor(identitySubkey.Bytes())
-	identitySubkey.Release()
-	common.KeepAlive(_identitySubkey)
+	identitySubkey := IdentitySubkey(s.iPSK, requestSalt, s.keySaltLength)
+	err = decryptIdentityHeader(s.blockConstructor, identitySubkey, eiHeader, eiHeader)
 	if err != nil {
 		return err
 	}
-	b.Decrypt(eiHeader, eiHeader)
 
 	var user U
 	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
 		user = u
 	} else {
-		return E.New("invalid request")
+		return ErrUnknownIdentity
 	}
 	common.KeepAlive(_eiHeader)
 
@@ -196,7 +258,18 @@ func (s *RelayService[U]) newConnection(ctx context.Context, conn net.Conn, meta
 
 	metadata.Protocol = "shadowsocks-relay"
 	metadata.Destination = s.uDestination[user]
+	latency := shadowsocks.HandshakeSuccess(conn)
+	if s.events != nil {
+		s.events.HandleEvent(ctx, shadowsocks.Event{Type: shadowsocks.EventHandshakeAccepted, Network: N.NetworkTCP, Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: user, Latency: latency})
+	}
 	conn = bufio.NewCachedConn(conn, requestHeader)
+	if s.tracker != nil {
+		conn = s.tracker.TrackConn(user, conn)
+	}
+	if s.registry != nil {
+		conn = s.registry.TrackConn(conn, metadata, user)
+		defer s.registry.Untrack(conn)
+	}
 	return s.handler.NewConnection(auth.ContextWithUser(ctx, user), conn, metadata)
 }
 
@@ -206,12 +279,23 @@ func (s *RelayService[U]) WriteIsThreadUnsafe() {
 func (s *RelayService[U]) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
 	err := s.newPacket(ctx, conn, buffer, metadata)
 	if err != nil {
+		if s.events != nil {
+			reportError(ctx, s.events, s.name, N.NetworkUDP, metadata, err)
+		}
 		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
 func (s *RelayService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	if !s.shutdown.AcquirePacket() {
+		return shadowsocks.ErrServiceClosed
+	}
+	defer s.shutdown.ReleasePacket()
+	if s.udpBlockCipher == nil {
+		return s.newChaChaPacket(ctx, conn, buffer, metadata)
+	}
+
 	packetHeader := buffer.To(aes.BlockSize)
 	s.udpBlockCipher.Decrypt(packetHeader, packetHeader)
 
@@ -226,21 +310,85 @@ func (s *RelayService[U]) newPacket(ctx context.Context, conn N.PacketConn, buff
 	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
 		user = u
 	} else {
-		return E.New("invalid request")
+		return ErrUnknownIdentity
 	}
 
 	s.uCipher[user].Encrypt(packetHeader, packetHeader)
 	copy(buffer.Range(aes.BlockSize, 2*aes.BlockSize), packetHeader)
 	buffer.Advance(aes.BlockSize)
+	return s.relayPacket(ctx, conn, buffer, metadata, user, sessionId)
+}
+
+// newChaChaPacket strips the identity header of a ChaCha packet. The session id is
+// encrypted with the user key, so a copy of the packet is opened to read it.
+func (s *RelayService[U]) newChaChaPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	if buffer.Len() < PacketNonceSize+aes.BlockSize+PacketMinimalHeaderSize {
+		return ErrPacketTooShort
+	}
+
+	var _eiHeader [aes.BlockSize]byte
+	eiHeader := common.Dup(_eiHeader[:])
+	identitySubkey := IdentitySubkey(s.iPSK, buffer.To(PacketNonceSize), s.keySaltLength)
+	err := xorIdentityHeader(identitySubkey, eiHeader, buffer.Range(PacketNonceSize, PacketNonceSize+aes.BlockSize))
+	if err != nil {
+		return err
+	}
+
+	var user U
+	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
+		user = u
+	} else {
+		return ErrUnknownIdentity
+	}
+
+	sealedHeader := buffer.From(PacketNonceSize + aes.BlockSize)
+	header := buf.NewSize(len(sealedHeader))
+	defer header.Release()
+	_, err = s.uUDPCipher[user].Open(header.Extend(len(sealedHeader))[:0], buffer.To(PacketNonceSize), sealedHeader, nil)
+	if err != nil {
+		return E.Cause(err, "decrypt packet header")
+	}
+	sessionId := binary.BigEndian.Uint64(header.Bytes())
+
+	copy(buffer.Range(aes.BlockSize, aes.BlockSize+PacketNonceSize), buffer.To(PacketNonceSize))
+	buffer.Advance(aes.BlockSize)
+	return s.relayPacket(ctx, conn, buffer, metadata, user, sessionId)
+}
+
+func (s *RelayService[U]) relayPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata, user U, sessionId uint64) error {
 
 	metadata.Protocol = "shadowsocks-relay"
 	metadata.Destination = s.uDestination[user]
+	tracker := s.tracker
+	if tracker != nil {
+		tracker.TrackUpload(user, buffer.Len())
+	}
+	packetLen := buffer.Len()
 	s.udpNat.NewContextPacket(ctx, sessionId, buffer, metadata, func(natConn N.PacketConn) (context.Context, N.PacketWriter) {
-		return auth.ContextWithUser(ctx, user), &udpnat.DirectBackWriter{Source: conn, Nat: natConn}
+		var writer N.PacketWriter = &udpnat.DirectBackWriter{Source: conn, Nat: natConn}
+		if tracker != nil {
+			writer = tracker.TrackPacketWriter(user, writer)
+		}
+		if s.registry != nil {
+			writer = s.registry.TrackPacketWriter(s, sessionId, 0, natConn, writer, metadata, user)
+		}
+		if s.events != nil {
+			event := shadowsocks.Event{Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: user, SessionID: sessionId}
+			writer = shadowsocks.SessionEventWriter(ctx, s.events, event, writer)
+		}
+		return auth.ContextWithUser(ctx, user), s.shutdown.TrackPacketWriter(natConn, writer)
 	})
+	if s.registry != nil {
+		s.registry.TrackPacket(s, sessionId, packetLen)
+	}
 	return nil
 }
 
+// Shutdown stops accepting new connections and packets, see shadowsocks.ShutdownGroup.
+func (s *RelayService[U]) Shutdown(ctx context.Context) (int, error) {
+	return s.shutdown.Shutdown(ctx)
+}
+
 func (s *RelayService[U]) NewError(ctx context.Context, err error) {
 	s.handler.NewError(ctx, err)
 }
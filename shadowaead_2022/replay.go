@@ -0,0 +1,50 @@
+package shadowaead_2022
+
+import (
+	"sync"
+	"time"
+)
+
+// saltFilter is the default replay filter of services. Salts are kept by the service clock
+// for twice the timestamp tolerance, so a request is remembered for as long as it would be
+// accepted by the timestamp check.
+type saltFilter struct {
+	access    sync.Mutex
+	clock     Clock
+	window    time.Duration
+	lastClean time.Time
+	pool      map[string]time.Time
+}
+
+func newSaltFilter(clock Clock, tolerance time.Duration) *saltFilter {
+	// timestamps have a resolution of one second
+	window := 2*tolerance + time.Second
+	if window < time.Minute {
+		window = time.Minute
+	}
+	return &saltFilter{
+		clock:     clock,
+		window:    window,
+		lastClean: clock.Now(),
+		pool:      make(map[string]time.Time),
+	}
+}
+
+func (f *saltFilter) Check(salt []byte) bool {
+	now := f.clock.Now()
+	f.access.Lock()
+	defer f.access.Unlock()
+	if now.Sub(f.lastClean) > f.window {
+		for oldSalt, added := range f.pool {
+			if now.Sub(added) > f.window {
+				delete(f.pool, oldSalt)
+			}
+		}
+		f.lastClean = now
+	}
+	if added, loaded := f.pool[string(salt)]; loaded && now.Sub(added) <= f.window {
+		return false
+	}
+	f.pool[string(salt)] = now
+	return true
+}
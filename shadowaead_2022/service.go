@@ -4,17 +4,13 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"io"
-	"math"
-	mRand "math/rand"
 	"net"
 	"os"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing-shadowsocks/shadowaead"
@@ -25,7 +21,6 @@ import (
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
-	"github.com/sagernet/sing/common/replay"
 	"github.com/sagernet/sing/common/udpnat"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -36,7 +31,7 @@ var (
 	ErrBadPadding = E.New("bad request: damaged padding")
 )
 
-var _ shadowsocks.Service = (*Service)(nil)
+var _ shadowsocks.ShutdownService = (*Service)(nil)
 
 type Service struct {
 	name          string
@@ -49,12 +44,21 @@ type Service struct {
 	udpBlockCipher   cipher.Block
 	psk              []byte
 
-	replayFilter replay.Filter
-	udpNat       *udpnat.Service[uint64]
-	udpSessions  *cache.LruCache[uint64, *serverUDPSession]
+	serviceOptions
+
+	failurePolicy shadowsocks.FailurePolicy
+	registry      *shadowsocks.Registry
+	events        shadowsocks.EventHandler
+	shutdown      shadowsocks.ShutdownGroup
+	mux           bool
+	udpNat        *udpnat.Service[uint64]
+	udpSessions   *cache.LruCache[uint64, *serverUDPSession]
+	sessionAccess sync.Mutex
+	natAccess     sync.Mutex
+	natSessions   map[uint64]struct{}
 }
 
-func NewServiceWithPassword(method string, password string, udpTimeout int64, handler shadowsocks.Handler) (shadowsocks.Service, error) {
+func NewServiceWithPassword(method string, password string, udpTimeout int64, handler shadowsocks.Handler, options ...ServiceOption) (shadowsocks.Service, error) {
 	if password == "" {
 		return nil, ErrMissingPSK
 	}
@@ -62,20 +66,26 @@ func NewServiceWithPassword(method string, password string, udpTimeout int64, ha
 	if err != nil {
 		return nil, E.Cause(err, "decode psk")
 	}
-	return NewService(method, psk, udpTimeout, handler)
+	return NewService(method, psk, udpTimeout, handler, options...)
 }
 
-func NewService(method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler) (shadowsocks.Service, error) {
+func NewService(method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler, options ...ServiceOption) (shadowsocks.Service, error) {
+	o, err := newServiceOptions(options)
+	if err != nil {
+		return nil, err
+	}
 	s := &Service{
-		name:    method,
-		handler: handler,
+		name:           method,
+		handler:        handler,
+		serviceOptions: o,
 
-		replayFilter: replay.NewSimple(60 * time.Second),
-		udpNat:       udpnat.New[uint64](udpTimeout, handler),
+		udpNat: udpnat.New[uint64](udpTimeout, handler),
 		udpSessions: cache.New[uint64, *serverUDPSession](
 			cache.WithAge[uint64, *serverUDPSession](udpTimeout),
 			cache.WithUpdateAgeOnGet[uint64, *serverUDPSession](),
+			cache.WithSize[uint64, *serverUDPSession](o.udpSessionCacheSize),
 		),
+		natSessions: make(map[uint64]struct{}),
 	}
 
 	switch method {
@@ -104,7 +114,6 @@ func NewService(method string, psk []byte, udpTimeout int64, handler shadowsocks
 		}
 	}
 
-	var err error
 	switch method {
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		s.udpBlockCipher, err = aes.NewCipher(psk)
@@ -127,10 +136,47 @@ func (s *Service) Password() string {
 	return base64.StdEncoding.EncodeToString(s.psk)
 }
 
+// SetFailurePolicy sets how connections that fail the handshake are handled, nil resets them.
+func (s *Service) SetFailurePolicy(policy shadowsocks.FailurePolicy) {
+	s.failurePolicy = policy
+}
+
+// SetRegistry enables tracking of live connections and UDP sessions, nil disables it.
+func (s *Service) SetRegistry(registry *shadowsocks.Registry) {
+	s.registry = registry
+}
+
+// SetEventHandler sets the handler of structured events, nil disables them.
+func (s *Service) SetEventHandler(handler shadowsocks.EventHandler) {
+	s.events = handler
+}
+
+// SetMux enables serving mux sessions, each stream is tracked as a connection.
+func (s *Service) SetMux(enabled bool) {
+	s.mux = enabled
+}
+
+func (s *Service) handleConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, user any) error {
+	if s.mux {
+		return shadowsocks.HandleMuxConnection(ctx, s.handler, conn, metadata, shadowsocks.MuxOptions{Registry: s.registry, User: user, Shutdown: &s.shutdown})
+	}
+	return shadowsocks.HandleConnection(ctx, s.handler, conn, metadata)
+}
+
 func (s *Service) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	return s.serveConnection(ctx, conn, metadata, s.newConnection)
+}
+
+func (s *Service) serveConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, serve func(ctx context.Context, conn net.Conn, metadata M.Metadata) error) error {
+	var err error
+	if s.shutdown.AcquireConn(conn) {
+		err = shadowsocks.ServeConnection(ctx, conn, metadata, s.failurePolicy, serve)
+		s.shutdown.ReleaseConn(conn)
+	} else {
+		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: shadowsocks.ErrServiceClosed, Handshake: true}
+	}
+	if s.events != nil && shadowsocks.IsHandshakeError(err) {
+		reportError(ctx, s.events, s.name, N.NetworkTCP, metadata, err)
 	}
 	return err
 }
@@ -183,9 +229,9 @@ func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.M
 		return err
 	}
 
-	diff := int(math.Abs(float64(time.Now().Unix() - int64(epoch))))
-	if diff > 30 {
-		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = checkTimestamp(s.clock.Now(), epoch, s.timestampTolerance)
+	if err != nil {
+		return err
 	}
 
 	var length uint16
@@ -235,7 +281,16 @@ func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.M
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	return s.handler.NewConnection(ctx, protocolConn, metadata)
+	latency := shadowsocks.HandshakeSuccess(conn)
+	if s.events != nil {
+		s.events.HandleEvent(ctx, shadowsocks.Event{Type: shadowsocks.EventHandshakeAccepted, Network: N.NetworkTCP, Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: nil, Latency: latency})
+	}
+	if s.registry != nil {
+		registryConn := s.registry.TrackConn(protocolConn, metadata, nil)
+		defer s.registry.Untrack(registryConn)
+		return s.handleConnection(ctx, registryConn, metadata, nil)
+	}
+	return s.handleConnection(ctx, protocolConn, metadata, nil)
 }
 
 type serverConn struct {
@@ -252,7 +307,7 @@ type serverConn struct {
 func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
 	_salt := buf.StackNewSize(c.keySaltLength)
 	salt := common.Dup(_salt)
-	salt.WriteRandom(salt.FreeLen())
+	common.Must1(salt.ReadFullFrom(c.rng, salt.FreeLen()))
 
 	key := SessionKey(c.uPSK, salt.Bytes(), c.keySaltLength)
 	common.KeepAlive(_salt)
@@ -265,7 +320,7 @@ func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
 	writer := shadowaead.NewWriter(
 		c.Conn,
 		writeCipher,
-		MaxPacketSize,
+		c.maxPacketSize,
 	)
 	common.KeepAlive(key)
 	header := writer.Buffer()
@@ -280,7 +335,7 @@ func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
 	_headerFixedChunk := buf.StackNewSize(1 + 8 + c.keySaltLength + 2)
 	headerFixedChunk := common.Dup(_headerFixedChunk)
 	common.Must(headerFixedChunk.WriteByte(headerType))
-	common.Must(binary.Write(headerFixedChunk, binary.BigEndian, uint64(time.Now().Unix())))
+	common.Must(binary.Write(headerFixedChunk, binary.BigEndian, uint64(c.clock.Now().Unix())))
 	common.Must1(headerFixedChunk.Write(c.requestSalt))
 	common.Must(binary.Write(headerFixedChunk, binary.BigEndian, uint16(payloadLen)))
 
@@ -381,12 +436,19 @@ func (s *Service) WriteIsThreadUnsafe() {
 func (s *Service) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
 	err := s.newPacket(ctx, conn, buffer, metadata)
 	if err != nil {
+		if s.events != nil {
+			reportError(ctx, s.events, s.name, N.NetworkUDP, metadata, err)
+		}
 		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
 func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	if !s.shutdown.AcquirePacket() {
+		return shadowsocks.ErrServiceClosed
+	}
+	defer s.shutdown.ReleasePacket()
 	var packetHeader []byte
 	if s.udpCipher != nil {
 		if buffer.Len() < PacketNonceSize+PacketMinimalHeaderSize {
@@ -416,8 +478,12 @@ func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.
 		return err
 	}
 
-	session, loaded := s.udpSessions.LoadOrStore(sessionId, s.newUDPSession)
+	session, loaded := s.loadOrStoreUDPSession(sessionId, s.newUDPSession)
 	if !loaded {
+		if s.hasNATSession(sessionId) {
+			err = ErrEvictedSession
+			goto returnErr
+		}
 		session.remoteSessionId = sessionId
 		if packetHeader != nil {
 			key := SessionKey(s.psk, packetHeader[:8], s.keySaltLength)
@@ -438,7 +504,7 @@ returnErr:
 
 process:
 	if !session.window.Check(packetId) {
-		err = ErrPacketIdNotUnique
+		err = &PacketIDError{sessionId, packetId}
 		goto returnErr
 	}
 
@@ -469,9 +535,8 @@ process:
 	if err != nil {
 		goto returnErr
 	}
-	diff := int(math.Abs(float64(time.Now().Unix() - int64(epoch))))
-	if diff > 30 {
-		err = E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = checkTimestamp(s.clock.Now(), epoch, s.timestampTolerance)
+	if err != nil {
 		goto returnErr
 	}
 
@@ -489,12 +554,73 @@ process:
 	}
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
+	packetLen := buffer.Len()
 	s.udpNat.NewPacket(ctx, sessionId, buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
-		return &serverPacketWriter{s, conn, natConn, session, s.udpBlockCipher}
+		var writer N.PacketWriter = &serverPacketWriter{s, conn, natConn, session, s.udpBlockCipher, s.udpCipher}
+		writer = s.trackNATSession(sessionId, writer)
+		if s.registry != nil {
+			writer = s.registry.TrackPacketWriter(s, sessionId, sessionId, natConn, writer, metadata, nil)
+		}
+		if s.events != nil {
+			writer = shadowsocks.SessionEventWriter(ctx, s.events, shadowsocks.Event{Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: nil, SessionID: sessionId}, writer)
+		}
+		return s.shutdown.TrackPacketWriter(natConn, writer)
 	})
+	if s.registry != nil {
+		s.registry.TrackPacket(s, sessionId, packetLen)
+	}
 	return nil
 }
 
+// loadOrStoreUDPSession is udpSessions.LoadOrStore honouring the cache size, which only
+// Store enforces.
+func (s *Service) loadOrStoreUDPSession(sessionId uint64, constructor func() *serverUDPSession) (*serverUDPSession, bool) {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	session, loaded := s.udpSessions.Load(sessionId)
+	if loaded {
+		return session, true
+	}
+	session = constructor()
+	s.udpSessions.Store(sessionId, session)
+	return session, false
+}
+
+// trackNATSession registers sessionId until the UDP NAT entry of the session is closed.
+func (s *Service) trackNATSession(sessionId uint64, writer N.PacketWriter) N.PacketWriter {
+	s.natAccess.Lock()
+	s.natSessions[sessionId] = struct{}{}
+	s.natAccess.Unlock()
+	return &sessionPacketWriter{PacketWriter: writer, onClose: func() {
+		s.natAccess.Lock()
+		delete(s.natSessions, sessionId)
+		s.natAccess.Unlock()
+	}}
+}
+
+// hasNATSession reports whether the UDP NAT entry of sessionId is live. A session missing
+// from the session cache while its NAT entry is live was evicted by the cache size limit,
+// its packet id window is lost, so its packets are rejected until the NAT entry expires.
+func (s *Service) hasNATSession(sessionId uint64) bool {
+	s.natAccess.Lock()
+	defer s.natAccess.Unlock()
+	_, loaded := s.natSessions[sessionId]
+	return loaded
+}
+
+// Shutdown stops accepting new connections and packets, see shadowsocks.ShutdownGroup.
+func (s *Service) Shutdown(ctx context.Context) (int, error) {
+	forceClosed, err := s.shutdown.Shutdown(ctx)
+	var sessionIds []uint64
+	s.udpSessions.Range(func(sessionId uint64, session *serverUDPSession) {
+		sessionIds = append(sessionIds, sessionId)
+	})
+	for _, sessionId := range sessionIds {
+		s.udpSessions.Delete(sessionId)
+	}
+	return forceClosed, err
+}
+
 func (s *Service) NewError(ctx context.Context, err error) {
 	s.handler.NewError(ctx, err)
 }
@@ -505,6 +631,7 @@ type serverPacketWriter struct {
 	nat            N.PacketConn
 	session        *serverUDPSession
 	udpBlockCipher cipher.Block
+	udpCipher      cipher.AEAD
 }
 
 func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
@@ -513,18 +640,18 @@ func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socks
 		hdrLen = PacketNonceSize
 	}
 
-	var paddingLen int
-	if destination.Port == 53 && buffer.Len() < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength-buffer.Len()) + 1
-	}
-
 	hdrLen += 16 // packet header
 	hdrLen += 1  // header type
 	hdrLen += 8  // timestamp
 	hdrLen += 8  // remote session id
 	hdrLen += 2  // padding length
-	hdrLen += paddingLen
 	hdrLen += M.SocksaddrSerializer.AddrPortLen(destination)
+	paddingLen, err := paddingLength(w.paddingPolicy, w.rng, N.NetworkUDP, destination, buffer.Len(), hdrLen+shadowaead.Overhead)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	hdrLen += paddingLen
 	header := buf.With(buffer.ExtendHeader(hdrLen))
 
 	var dataIndex int
@@ -539,7 +666,7 @@ func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socks
 		binary.Write(header, binary.BigEndian, w.session.sessionId),
 		binary.Write(header, binary.BigEndian, w.session.nextPacketId()),
 		header.WriteByte(HeaderTypeServer),
-		binary.Write(header, binary.BigEndian, uint64(time.Now().Unix())),
+		binary.Write(header, binary.BigEndian, uint64(w.clock.Now().Unix())),
 		binary.Write(header, binary.BigEndian, w.session.remoteSessionId),
 		binary.Write(header, binary.BigEndian, uint16(paddingLen)), // padding length
 	)
@@ -548,7 +675,7 @@ func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socks
 		header.Extend(paddingLen)
 	}
 
-	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
+	err = M.SocksaddrSerializer.WriteAddrPort(header, destination)
 	if err != nil {
 		buffer.Release()
 		return err
@@ -606,10 +733,10 @@ func (s *serverUDPSession) nextPacketId() uint64 {
 func (s *Service) newUDPSession() *serverUDPSession {
 	session := &serverUDPSession{}
 	if s.udpCipher != nil {
-		session.rng = Blake3KeyedHash(rand.Reader)
+		session.rng = Blake3KeyedHash(s.rng)
 		common.Must(binary.Read(session.rng, binary.BigEndian, &session.sessionId))
 	} else {
-		common.Must(binary.Read(rand.Reader, binary.BigEndian, &session.sessionId))
+		common.Must(binary.Read(s.rng, binary.BigEndian, &session.sessionId))
 	}
 	session.packetId--
 	if s.udpCipher == nil {
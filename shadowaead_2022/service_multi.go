@@ -4,13 +4,11 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
-	"math"
+	"io"
 	"net"
-	"os"
-	"time"
+	"sync"
 
 	shadowsocks "github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing-shadowsocks/shadowaead"
@@ -23,6 +21,13 @@ import (
 	"github.com/sagernet/sing/common/rw"
 
 	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	ErrUserExists   = E.New("user already exists")
+	ErrUserNotFound = E.New("user not found")
+	ErrDuplicateKey = E.New("user key already in use")
 )
 
 type MultiService[U comparable] struct {
@@ -30,10 +35,19 @@ type MultiService[U comparable] struct {
 
 	uPSK     map[U][]byte
 	uPSKHash map[[aes.BlockSize]byte]U
-	uCipher  map[U]cipher.Block
+	uCipher  map[U]userCipher
+	tracker  *shadowsocks.TrafficTracker[U]
+
+	access sync.RWMutex
+
+	limitAccess sync.RWMutex
+	limits      map[U]*userLimiter
+
+	sessionAccess sync.Mutex
+	sessions      map[U]map[io.Closer]struct{}
 }
 
-func NewMultiServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler) (*MultiService[U], error) {
+func NewMultiServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler, options ...ServiceOption) (*MultiService[U], error) {
 	if password == "" {
 		return nil, ErrMissingPSK
 	}
@@ -41,18 +55,11 @@ func NewMultiServiceWithPassword[U comparable](method string, password string, u
 	if err != nil {
 		return nil, E.Cause(err, "decode psk")
 	}
-	return NewMultiService[U](method, iPSK, udpTimeout, handler)
+	return NewMultiService[U](method, iPSK, udpTimeout, handler, options...)
 }
 
-func NewMultiService[U comparable](method string, iPSK []byte, udpTimeout int64, handler shadowsocks.Handler) (*MultiService[U], error) {
-	switch method {
-	case "2022-blake3-aes-128-gcm":
-	case "2022-blake3-aes-256-gcm":
-	default:
-		return nil, os.ErrInvalid
-	}
-
-	ss, err := NewService(method, iPSK, udpTimeout, handler)
+func NewMultiService[U comparable](method string, iPSK []byte, udpTimeout int64, handler shadowsocks.Handler, options ...ServiceOption) (*MultiService[U], error) {
+	ss, err := NewService(method, iPSK, udpTimeout, handler, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -62,41 +69,212 @@ func NewMultiService[U comparable](method string, iPSK []byte, udpTimeout int64,
 
 		uPSK:     make(map[U][]byte),
 		uPSKHash: make(map[[aes.BlockSize]byte]U),
+		uCipher:  make(map[U]userCipher),
 	}
 	return s, nil
 }
 
-func (s *MultiService[U]) UpdateUsers(userList []U, keyList [][]byte) error {
-	uPSK := make(map[U][]byte)
-	uPSKHash := make(map[[aes.BlockSize]byte]U)
-	uCipher := make(map[U]cipher.Block)
+// SetTrafficTracker enables per-user traffic accounting, nil disables it.
+func (s *MultiService[U]) SetTrafficTracker(tracker *shadowsocks.TrafficTracker[U]) {
+	s.tracker = tracker
+}
+
+// UpdateLimits replaces the limits of users, users not in the list become unlimited.
+// Counters of existing users are kept, also for users removed and added back while
+// their sessions are live, so established sessions are not affected.
+func (s *MultiService[U]) UpdateLimits(userList []U, limitList []UserLimit) error {
+	if len(userList) != len(limitList) {
+		return shadowsocks.ErrListLengthMismatch
+	}
+	s.limitAccess.Lock()
+	defer s.limitAccess.Unlock()
+	limits := make(map[U]*userLimiter)
 	for i, user := range userList {
-		key := keyList[i]
-		if len(key) < s.keySaltLength {
-			return shadowsocks.ErrBadKey
-		} else if len(key) > s.keySaltLength {
-			key = Key(key, s.keySaltLength)
+		if limiter, loaded := s.limits[user]; loaded {
+			limiter.update(limitList[i])
+			limits[user] = limiter
+		} else {
+			limits[user] = newUserLimiter(s.clock, limitList[i])
 		}
+	}
+	for user, limiter := range s.limits {
+		if _, loaded := limits[user]; !loaded && limiter.remove() {
+			limits[user] = limiter
+		}
+	}
+	s.limits = limits
+	return nil
+}
 
-		var hash [aes.BlockSize]byte
-		hash512 := blake3.Sum512(key)
-		copy(hash[:], hash512[:])
+func (s *MultiService[U]) limiter(user U) *userLimiter {
+	s.limitAccess.RLock()
+	defer s.limitAccess.RUnlock()
+	return s.limits[user]
+}
 
-		uPSKHash[hash] = user
-		uPSK[user] = key
-		var err error
-		uCipher[user], err = s.blockConstructor(key)
+func (s *MultiService[U]) UpdateUsers(userList []U, keyList [][]byte) error {
+	if len(userList) != len(keyList) {
+		return shadowsocks.ErrListLengthMismatch
+	}
+	uPSK := make(map[U][]byte)
+	uPSKHash := make(map[[aes.BlockSize]byte]U)
+	uCipher := make(map[U]userCipher)
+	for i, user := range userList {
+		key, hash, userCipher, err := s.newUserKey(keyList[i])
 		if err != nil {
 			return err
 		}
+		uPSKHash[hash] = user
+		uPSK[user] = key
+		uCipher[user] = userCipher
 	}
 
+	s.access.Lock()
 	s.uPSK = uPSK
 	s.uPSKHash = uPSKHash
 	s.uCipher = uCipher
+	s.access.Unlock()
 	return nil
 }
 
+func (s *MultiService[U]) AddUser(user U, key []byte) error {
+	key, hash, uCipher, err := s.newUserKey(key)
+	if err != nil {
+		return err
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	if _, loaded := s.uPSK[user]; loaded {
+		return ErrUserExists
+	}
+	if _, loaded := s.uPSKHash[hash]; loaded {
+		return ErrDuplicateKey
+	}
+	s.uPSKHash[hash] = user
+	s.uPSK[user] = key
+	s.uCipher[user] = uCipher
+	return nil
+}
+
+// RemoveUser removes the user, live connections and udp sessions of the user are closed if closeSessions is set.
+func (s *MultiService[U]) RemoveUser(user U, closeSessions bool) error {
+	s.access.Lock()
+	key, loaded := s.uPSK[user]
+	if loaded {
+		delete(s.uPSKHash, userKeyHash(key))
+		delete(s.uPSK, user)
+		delete(s.uCipher, user)
+	}
+	s.access.Unlock()
+	if !loaded {
+		return ErrUserNotFound
+	}
+	if closeSessions {
+		s.closeSessions(user)
+	}
+	return nil
+}
+
+// ReplaceUserKey changes the key of the user, established sessions keep using the old key.
+func (s *MultiService[U]) ReplaceUserKey(user U, key []byte) error {
+	key, hash, uCipher, err := s.newUserKey(key)
+	if err != nil {
+		return err
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	oldKey, loaded := s.uPSK[user]
+	if !loaded {
+		return ErrUserNotFound
+	}
+	oldHash := userKeyHash(oldKey)
+	if owner, loaded := s.uPSKHash[hash]; loaded && (hash != oldHash || owner != user) {
+		return ErrDuplicateKey
+	}
+	delete(s.uPSKHash, oldHash)
+	s.uPSKHash[hash] = user
+	s.uPSK[user] = key
+	s.uCipher[user] = uCipher
+	return nil
+}
+
+type userCipher struct {
+	block     cipher.Block
+	udpCipher cipher.AEAD
+}
+
+func (s *MultiService[U]) newUserKey(key []byte) ([]byte, [aes.BlockSize]byte, userCipher, error) {
+	var hash [aes.BlockSize]byte
+	var uCipher userCipher
+	if len(key) < s.keySaltLength {
+		return nil, hash, uCipher, shadowsocks.ErrBadKey
+	} else if len(key) > s.keySaltLength {
+		key = Key(key, s.keySaltLength)
+	}
+	var err error
+	if s.udpCipher != nil {
+		uCipher.udpCipher, err = chacha20poly1305.NewX(key)
+	} else {
+		uCipher.block, err = s.blockConstructor(key)
+	}
+	if err != nil {
+		return nil, hash, uCipher, err
+	}
+	return key, userKeyHash(key), uCipher, nil
+}
+
+func userKeyHash(key []byte) [aes.BlockSize]byte {
+	var hash [aes.BlockSize]byte
+	hash512 := blake3.Sum512(key)
+	copy(hash[:], hash512[:])
+	return hash
+}
+
+func (s *MultiService[U]) loadUser(hash [aes.BlockSize]byte) (user U, uPSK []byte, uCipher userCipher, loaded bool) {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	user, loaded = s.uPSKHash[hash]
+	if loaded {
+		uPSK = s.uPSK[user]
+		uCipher = s.uCipher[user]
+	}
+	return
+}
+
+func (s *MultiService[U]) addSession(user U, session io.Closer) {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[U]map[io.Closer]struct{})
+	}
+	userSessions := s.sessions[user]
+	if userSessions == nil {
+		userSessions = make(map[io.Closer]struct{})
+		s.sessions[user] = userSessions
+	}
+	userSessions[session] = struct{}{}
+}
+
+func (s *MultiService[U]) removeSession(user U, session io.Closer) {
+	s.sessionAccess.Lock()
+	defer s.sessionAccess.Unlock()
+	userSessions := s.sessions[user]
+	delete(userSessions, session)
+	if len(userSessions) == 0 {
+		delete(s.sessions, user)
+	}
+}
+
+func (s *MultiService[U]) closeSessions(user U) {
+	s.sessionAccess.Lock()
+	userSessions := s.sessions[user]
+	delete(s.sessions, user)
+	s.sessionAccess.Unlock()
+	for session := range userSessions {
+		session.Close()
+	}
+}
+
 func (s *MultiService[U]) UpdateUsersWithPasswords(userList []U, passwordList []string) error {
 	keyList := make([][]byte, 0, len(passwordList))
 	for _, password := range passwordList {
@@ -113,11 +291,7 @@ func (s *MultiService[U]) UpdateUsersWithPasswords(userList []U, passwordList []
 }
 
 func (s *MultiService[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
-	}
-	return err
+	return s.serveConnection(ctx, conn, metadata, s.newConnection)
 }
 
 func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
@@ -137,28 +311,15 @@ func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, meta
 	eiHeader := common.Dup(_eiHeader[:])
 	copy(eiHeader, requestHeader[s.keySaltLength:s.keySaltLength+aes.BlockSize])
 
-	keyMaterial := buf.Make(s.keySaltLength * 2)
-	copy(keyMaterial, s.psk)
-	copy(keyMaterial[s.keySaltLength:], requestSalt)
-	_identitySubkey := buf.StackNewSize(s.keySaltLength)
-	identitySubkey := common.Dup(_identitySubkey)
-	identitySubkey.Extend(identitySubkey.FreeLen())
-	blake3.DeriveKey("shadowsocks 2022 identity subkey", keyMaterial, identitySubkey.Bytes())
-	b, err := s.blockConstructor(identitySubkey.Bytes())
-	identitySubkey.Release()
-	common.KeepAlive(_identitySubkey)
+	identitySubkey := IdentitySubkey(s.psk, requestSalt, s.keySaltLength)
+	err = decryptIdentityHeader(s.blockConstructor, identitySubkey, eiHeader, eiHeader)
 	if err != nil {
 		return err
 	}
-	b.Decrypt(eiHeader, eiHeader)
 
-	var user U
-	var uPSK []byte
-	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
-		user = u
-		uPSK = s.uPSK[u]
-	} else {
-		return E.New("invalid request")
+	user, uPSK, _, loaded := s.loadUser(_eiHeader)
+	if !loaded {
+		return ErrUnknownIdentity
 	}
 	common.KeepAlive(_eiHeader)
 
@@ -192,9 +353,9 @@ func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, meta
 	if err != nil {
 		return E.Cause(err, "read timestamp")
 	}
-	diff := int(math.Abs(float64(time.Now().Unix() - int64(epoch))))
-	if diff > 30 {
-		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = checkTimestamp(s.clock.Now(), epoch, s.timestampTolerance)
+	if err != nil {
+		return err
 	}
 	var length uint16
 	err = binary.Read(reader, binary.BigEndian, &length)
@@ -240,7 +401,54 @@ func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, meta
 	protocolConn.reader = reader
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	return s.handler.NewConnection(auth.ContextWithUser(ctx, user), protocolConn, metadata)
+	var userConn net.Conn = protocolConn
+	// the streams of a mux session are counted as connections instead of the session
+	muxSession := s.mux && shadowsocks.IsMuxDestination(destination)
+	if limiter := s.limiter(user); limiter != nil {
+		if muxSession {
+			err = limiter.checkQuota()
+		} else {
+			err = limiter.acquireConnection()
+		}
+		if err != nil {
+			return &LimitError{user, err}
+		}
+		limitedConn := &limitConn{Conn: protocolConn, user: user, limiter: limiter, counted: !muxSession}
+		defer limitedConn.release()
+		userConn = limitedConn
+	}
+	if s.tracker != nil {
+		userConn = s.tracker.TrackConn(user, userConn)
+	}
+	if s.registry != nil {
+		userConn = s.registry.TrackConn(userConn, metadata, user)
+		defer s.registry.Untrack(userConn)
+	}
+	s.addSession(user, conn)
+	defer s.removeSession(user, conn)
+	latency := shadowsocks.HandshakeSuccess(conn)
+	if s.events != nil {
+		s.events.HandleEvent(ctx, shadowsocks.Event{Type: shadowsocks.EventHandshakeAccepted, Network: N.NetworkTCP, Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: user, Latency: latency})
+	}
+	if muxSession {
+		return shadowsocks.HandleMuxConnection(auth.ContextWithUser(ctx, user), s.handler, userConn, metadata, shadowsocks.MuxOptions{
+			Registry: s.registry,
+			User:     user,
+			Shutdown: &s.shutdown,
+			AcquireStream: func() (func(), error) {
+				limiter := s.limiter(user)
+				if limiter == nil {
+					return nil, nil
+				}
+				err := limiter.acquireConnection()
+				if err != nil {
+					return nil, &LimitError{user, err}
+				}
+				return limiter.releaseConnection, nil
+			},
+		})
+	}
+	return shadowsocks.HandleConnection(auth.ContextWithUser(ctx, user), s.handler, userConn, metadata)
 }
 
 func (s *MultiService[U]) WriteIsThreadUnsafe() {
@@ -249,31 +457,54 @@ func (s *MultiService[U]) WriteIsThreadUnsafe() {
 func (s *MultiService[U]) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
 	err := s.newPacket(ctx, conn, buffer, metadata)
 	if err != nil {
+		if s.events != nil {
+			reportError(ctx, s.events, s.name, N.NetworkUDP, metadata, err)
+		}
 		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
 func (s *MultiService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	if buffer.Len() < PacketMinimalHeaderSize {
-		return ErrPacketTooShort
+	if !s.shutdown.AcquirePacket() {
+		return shadowsocks.ErrServiceClosed
 	}
-
-	packetHeader := buffer.To(aes.BlockSize)
-	s.udpBlockCipher.Decrypt(packetHeader, packetHeader)
-
+	defer s.shutdown.ReleasePacket()
+	var packetHeader []byte
 	var _eiHeader [aes.BlockSize]byte
 	eiHeader := common.Dup(_eiHeader[:])
-	s.udpBlockCipher.Decrypt(eiHeader, buffer.Range(aes.BlockSize, 2*aes.BlockSize))
-	xorWords(eiHeader, eiHeader, packetHeader)
-
-	var user U
-	var uPSK []byte
-	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
-		user = u
-		uPSK = s.uPSK[u]
+	if s.udpCipher != nil {
+		if buffer.Len() < PacketNonceSize+aes.BlockSize+PacketMinimalHeaderSize {
+			return ErrPacketTooShort
+		}
+		identitySubkey := IdentitySubkey(s.psk, buffer.To(PacketNonceSize), s.keySaltLength)
+		err := xorIdentityHeader(identitySubkey, eiHeader, buffer.Range(PacketNonceSize, PacketNonceSize+aes.BlockSize))
+		if err != nil {
+			return err
+		}
 	} else {
-		return E.New("invalid request")
+		if buffer.Len() < PacketMinimalHeaderSize {
+			return ErrPacketTooShort
+		}
+		packetHeader = buffer.To(aes.BlockSize)
+		s.udpBlockCipher.Decrypt(packetHeader, packetHeader)
+		s.udpBlockCipher.Decrypt(eiHeader, buffer.Range(aes.BlockSize, 2*aes.BlockSize))
+		xorWords(eiHeader, eiHeader, packetHeader)
+	}
+
+	user, uPSK, uCipher, found := s.loadUser(_eiHeader)
+	if !found {
+		return ErrUnknownIdentity
+	}
+
+	if packetHeader == nil {
+		dataIndex := PacketNonceSize + aes.BlockSize
+		_, err := uCipher.udpCipher.Open(buffer.Index(dataIndex), buffer.To(PacketNonceSize), buffer.From(dataIndex), nil)
+		if err != nil {
+			return E.Cause(err, "decrypt packet header")
+		}
+		buffer.Advance(dataIndex)
+		buffer.Truncate(buffer.Len() - shadowaead.Overhead)
 	}
 
 	var sessionId, packetId uint64
@@ -286,19 +517,27 @@ func (s *MultiService[U]) newPacket(ctx context.Context, conn N.PacketConn, buff
 		return err
 	}
 
-	buffer.Advance(aes.BlockSize)
+	if packetHeader != nil {
+		buffer.Advance(aes.BlockSize)
+	}
 
-	session, loaded := s.udpSessions.LoadOrStore(sessionId, func() *serverUDPSession {
+	session, loaded := s.loadOrStoreUDPSession(sessionId, func() *serverUDPSession {
 		return s.newUDPSession(uPSK)
 	})
 	if !loaded {
+		if s.hasNATSession(sessionId) {
+			err = ErrEvictedSession
+			goto returnErr
+		}
 		session.remoteSessionId = sessionId
-		key := SessionKey(uPSK, packetHeader[:8], s.keySaltLength)
-		session.remoteCipher, err = s.constructor(common.Dup(key))
-		if err != nil {
-			return err
+		if packetHeader != nil {
+			key := SessionKey(uPSK, packetHeader[:8], s.keySaltLength)
+			session.remoteCipher, err = s.constructor(common.Dup(key))
+			if err != nil {
+				return err
+			}
+			common.KeepAlive(key)
 		}
-		common.KeepAlive(key)
 	}
 
 	goto process
@@ -311,7 +550,7 @@ returnErr:
 
 process:
 	if !session.window.Check(packetId) {
-		err = ErrPacketIdNotUnique
+		err = &PacketIDError{sessionId, packetId}
 		goto returnErr
 	}
 
@@ -342,9 +581,8 @@ process:
 	if err != nil {
 		goto returnErr
 	}
-	diff := int(math.Abs(float64(time.Now().Unix() - int64(epoch))))
-	if diff > 30 {
-		err = E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = checkTimestamp(s.clock.Now(), epoch, s.timestampTolerance)
+	if err != nil {
 		goto returnErr
 	}
 
@@ -361,21 +599,81 @@ process:
 		goto returnErr
 	}
 
+	limiter := s.limiter(user)
+	// set until the session is handed to the udp nat
+	var udpSessionAcquired bool
+	if limiter != nil {
+		if !loaded {
+			err = limiter.tryAcquireUDPSession()
+			if err != nil {
+				err = &LimitError{user, err}
+				goto returnErr
+			}
+			udpSessionAcquired = true
+		}
+		allow, limitErr := limiter.allowPacket(buffer.Len())
+		if limitErr != nil || !allow {
+			if udpSessionAcquired {
+				limiter.releaseUDPSession()
+			}
+			if limitErr != nil {
+				err = &LimitError{user, limitErr}
+				goto returnErr
+			}
+			return nil
+		}
+	}
+
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
+	tracker := s.tracker
+	if tracker != nil {
+		tracker.TrackUpload(user, buffer.Len())
+	}
+	packetLen := buffer.Len()
 	s.udpNat.NewContextPacket(ctx, sessionId, buffer, metadata, func(natConn N.PacketConn) (context.Context, N.PacketWriter) {
-		return auth.ContextWithUser(ctx, user), &serverPacketWriter{s.Service, conn, natConn, session, s.uCipher[user]}
+		var writer N.PacketWriter = &serverPacketWriter{s.Service, conn, natConn, session, uCipher.block, uCipher.udpCipher}
+		writer = s.trackNATSession(sessionId, writer)
+		if limiter != nil {
+			if !udpSessionAcquired {
+				// the session expired from the udp nat but not from the session cache
+				limiter.acquireUDPSession()
+			}
+			udpSessionAcquired = false
+			writer = &limitPacketWriter{PacketWriter: writer, user: user, limiter: limiter}
+		}
+		s.addSession(user, natConn)
+		writer = &sessionPacketWriter{PacketWriter: writer, onClose: func() {
+			s.removeSession(user, natConn)
+		}}
+		if tracker != nil {
+			writer = tracker.TrackPacketWriter(user, writer)
+		}
+		if s.registry != nil {
+			writer = s.registry.TrackPacketWriter(s.Service, sessionId, sessionId, natConn, writer, metadata, user)
+		}
+		if s.events != nil {
+			writer = shadowsocks.SessionEventWriter(ctx, s.events, shadowsocks.Event{Method: s.name, Source: metadata.Source, Destination: metadata.Destination, User: user, SessionID: sessionId}, writer)
+		}
+		return auth.ContextWithUser(ctx, user), s.shutdown.TrackPacketWriter(natConn, writer)
 	})
+	if udpSessionAcquired {
+		// the udp nat already has the session
+		limiter.releaseUDPSession()
+	}
+	if s.registry != nil {
+		s.registry.TrackPacket(s.Service, sessionId, packetLen)
+	}
 	return nil
 }
 
 func (s *MultiService[U]) newUDPSession(uPSK []byte) *serverUDPSession {
 	session := &serverUDPSession{}
 	if s.udpCipher != nil {
-		session.rng = Blake3KeyedHash(rand.Reader)
+		session.rng = Blake3KeyedHash(s.rng)
 		common.Must(binary.Read(session.rng, binary.BigEndian, &session.sessionId))
 	} else {
-		common.Must(binary.Read(rand.Reader, binary.BigEndian, &session.sessionId))
+		common.Must(binary.Read(s.rng, binary.BigEndian, &session.sessionId))
 	}
 	session.packetId--
 	sessionId := make([]byte, 8)
@@ -387,3 +685,21 @@ func (s *MultiService[U]) newUDPSession(uPSK []byte) *serverUDPSession {
 	common.KeepAlive(key)
 	return session
 }
+
+type sessionPacketWriter struct {
+	N.PacketWriter
+	onClose func()
+	once    sync.Once
+}
+
+func (w *sessionPacketWriter) Close() error {
+	w.once.Do(w.onClose)
+	if closer, isCloser := w.PacketWriter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (w *sessionPacketWriter) Upstream() any {
+	return w.PacketWriter
+}
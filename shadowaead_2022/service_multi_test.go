@@ -3,6 +3,8 @@ package shadowaead_2022_test
 import (
 	"context"
 	"crypto/rand"
+	"errors"
+	"io"
 	"net"
 	"sync"
 	"testing"
@@ -54,6 +56,84 @@ func TestMultiService(t *testing.T) {
 	wg.Wait()
 }
 
+func TestMultiServiceRemoveUser(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var iPSK [16]byte
+	rand.Reader.Read(iPSK[:])
+
+	handler := &readHandler{accepted: make(chan struct{}, 1)}
+	multiService, err := shadowaead_2022.NewMultiService[string](method, iPSK[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uPSK [16]byte
+	rand.Reader.Read(uPSK[:])
+	err = multiService.AddUser("my user", uPSK[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if multiService.AddUser("my user", uPSK[:]) != shadowaead_2022.ErrUserExists {
+		t.Fatal("expected duplicate user")
+	}
+
+	client, err := shadowaead_2022.New(method, [][]byte{iPSK[:], uPSK[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() chan error {
+		serverConn, clientConn := net.Pipe()
+		t.Cleanup(func() {
+			common.Close(serverConn, clientConn)
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+		}()
+		go client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+		return done
+	}
+
+	live := dial()
+	<-handler.accepted
+	err = multiService.RemoveUser("my user", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-live
+	if err != nil {
+		t.Fatal(err)
+	}
+	if <-dial() == nil {
+		t.Fatal("removed user accepted")
+	}
+	if multiService.RemoveUser("my user", true) != shadowaead_2022.ErrUserNotFound {
+		t.Fatal("expected missing user")
+	}
+}
+
+type readHandler struct {
+	accepted chan struct{}
+}
+
+func (h *readHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.accepted <- struct{}{}
+	_, err := io.Copy(io.Discard, conn)
+	if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+	return nil
+}
+
+func (h *readHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *readHandler) NewError(ctx context.Context, err error) {
+}
+
 type multiHandler struct {
 	t  *testing.T
 	wg *sync.WaitGroup
@@ -3,14 +3,19 @@ package shadowaead_2022_test
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"net"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
 	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/replay"
 )
 
 func TestService(t *testing.T) {
@@ -48,3 +53,282 @@ func TestService(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestServiceTimestampTolerance(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	now := time.Unix(1700000000, 0)
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, shadowaead_2022.MethodWithClock(fixedClock(now.Add(time.Minute))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := &writeRecorder{}
+	_, err = client.DialEarlyConn(handshake, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tolerance := range []time.Duration{shadowaead_2022.DefaultTimestampTolerance, 2 * time.Minute} {
+		var wg sync.WaitGroup
+		service, err := shadowaead_2022.NewService(method, psk[:], 500, &multiHandler{t, &wg},
+			shadowaead_2022.ServiceWithClock(fixedClock(now)),
+			shadowaead_2022.ServiceWithTimestampTolerance(tolerance),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			clientConn.Write(handshake.buffer.Bytes())
+			clientConn.Close()
+		}()
+		if tolerance > time.Minute {
+			wg.Add(1)
+		}
+		err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		serverConn.Close()
+		if tolerance > time.Minute {
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var timestampErr *shadowaead_2022.TimestampError
+		if !errors.As(err, &timestampErr) {
+			t.Fatal("expected timestamp error, got ", err)
+		}
+		if timestampErr.Diff != time.Minute || timestampErr.Tolerance != tolerance {
+			t.Fatal("bad diff ", timestampErr.Diff, " or tolerance ", timestampErr.Tolerance)
+		}
+	}
+}
+
+type stepClock struct {
+	access sync.Mutex
+	now    time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.now
+}
+
+func (c *stepClock) Add(d time.Duration) {
+	c.access.Lock()
+	c.now = c.now.Add(d)
+	c.access.Unlock()
+}
+
+func TestServiceReplayWithinTolerance(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	now := time.Unix(1700000000, 0)
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, shadowaead_2022.MethodWithClock(fixedClock(now)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := &writeRecorder{}
+	_, err = client.DialEarlyConn(handshake, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	clock := &stepClock{now: now}
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &multiHandler{t, &wg},
+		shadowaead_2022.ServiceWithClock(clock),
+		shadowaead_2022.ServiceWithTimestampTolerance(2*time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			clientConn.Write(handshake.buffer.Bytes())
+			clientConn.Close()
+		}()
+		if i == 0 {
+			wg.Add(1)
+		}
+		err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		serverConn.Close()
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		// the timestamp of the replay is still accepted
+		clock.Add(90 * time.Second)
+	}
+	if !errors.Is(err, shadowaead_2022.ErrSaltNotUnique) {
+		t.Fatal("expected replay rejected after 90 seconds, got ", err)
+	}
+}
+
+func TestServiceSharedReplayFilter(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	_, err := shadowaead_2022.NewService(method, psk[:], 500, nil, shadowaead_2022.ServiceWithMaxPacketSize(0))
+	if !errors.Is(err, shadowaead_2022.ErrBadMaxPacketSize) {
+		t.Fatal("expected bad max packet size, got ", err)
+	}
+
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := &writeRecorder{}
+	_, err = client.DialEarlyConn(handshake, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	filter := replay.NewSimple(time.Minute)
+	for i := 0; i < 2; i++ {
+		var service shadowsocks.Service
+		service, err = shadowaead_2022.NewService(method, psk[:], 500, &multiHandler{t, &wg}, shadowaead_2022.ServiceWithReplayFilter(filter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			clientConn.Write(handshake.buffer.Bytes())
+			clientConn.Close()
+		}()
+		if i == 0 {
+			wg.Add(1)
+		}
+		err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		serverConn.Close()
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !errors.Is(err, shadowaead_2022.ErrSaltNotUnique) {
+		t.Fatal("expected replay rejected by the second service, got ", err)
+	}
+}
+
+func TestBadOptions(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	for _, test := range []struct {
+		serviceOption shadowaead_2022.ServiceOption
+		methodOption  shadowaead_2022.MethodOption
+		err           error
+	}{
+		{shadowaead_2022.ServiceWithClock(nil), shadowaead_2022.MethodWithClock(nil), shadowaead_2022.ErrMissingClock},
+		{shadowaead_2022.ServiceWithTimestampTolerance(-time.Second), shadowaead_2022.MethodWithTimestampTolerance(-time.Second), shadowaead_2022.ErrBadTimestampTolerance},
+		{shadowaead_2022.ServiceWithPaddingPolicy(nil), shadowaead_2022.MethodWithPaddingPolicy(nil), shadowaead_2022.ErrMissingPaddingPolicy},
+		{shadowaead_2022.ServiceWithRandom(nil), shadowaead_2022.MethodWithRandom(nil), shadowaead_2022.ErrMissingRandom},
+		{shadowaead_2022.ServiceWithMaxPacketSize(shadowaead_2022.MaxPacketSize + 1), shadowaead_2022.MethodWithMaxPacketSize(shadowaead_2022.MaxPacketSize + 1), shadowaead_2022.ErrBadMaxPacketSize},
+	} {
+		_, err := shadowaead_2022.NewService(method, psk[:], 500, nil, test.serviceOption)
+		if !errors.Is(err, test.err) {
+			t.Fatal("service: expected ", test.err, ", got ", err)
+		}
+		_, err = shadowaead_2022.NewMultiService[string](method, psk[:], 500, nil, test.serviceOption)
+		if !errors.Is(err, test.err) {
+			t.Fatal("multi service: expected ", test.err, ", got ", err)
+		}
+		_, err = shadowaead_2022.New(method, [][]byte{psk[:]}, test.methodOption)
+		if !errors.Is(err, test.err) {
+			t.Fatal("method: expected ", test.err, ", got ", err)
+		}
+	}
+}
+
+func TestServiceEvictedSessionReplay(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	handler := &relaySessionHandler{packets: make(chan string, 4)}
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, handler, shadowaead_2022.ServiceWithUDPSessionCacheSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	var packets [][]byte
+	for i := 0; i < 2; i++ {
+		captureConn := &packetCaptureConn{}
+		_, err = client.DialPacketConn(captureConn).WriteTo([]byte("ping"), destination.UDPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, captureConn.packets[0])
+	}
+	// the second session evicts the first one from the session cache
+	for _, packet := range packets {
+		err = service.NewPacket(context.Background(), nil, buf.As(append([]byte(nil), packet...)), M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = service.NewPacket(context.Background(), nil, buf.As(append([]byte(nil), packets[0]...)), M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+	if !errors.Is(err, shadowaead_2022.ErrEvictedSession) {
+		t.Fatal("expected replay of an evicted session rejected, got ", err)
+	}
+}
+
+func TestServiceRegistrySession(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	registry := shadowsocks.NewRegistry()
+	handler := &relaySessionHandler{packets: make(chan string, 2)}
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.(*shadowaead_2022.Service).SetRegistry(registry)
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureConn := &packetCaptureConn{}
+	packetConn := client.DialPacketConn(captureConn)
+	for i := 0; i < 2; i++ {
+		_, err = packetConn.WriteTo([]byte("ping"), M.ParseSocksaddr("1.1.1.1:53").UDPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.NewPacket(context.Background(), nil, buf.As(captureConn.packets[i]), M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions := registry.Sessions()
+	if len(sessions) != 1 {
+		t.Fatal("expected 1 session, got ", len(sessions))
+	}
+	if sessions[0].SessionID == 0 || sessions[0].UploadPackets != 2 || sessions[0].UploadBytes != 8 {
+		t.Fatal("bad session ", sessions[0].SessionID, ": ", sessions[0].UploadPackets, " packets, ", sessions[0].UploadBytes, " bytes")
+	}
+}
@@ -22,3 +22,25 @@ func FetchMethod(method string, password string) (shadowsocks.Method, error) {
 		return nil, E.New("shadowsocks: unsupported method ", method)
 	}
 }
+
+func FetchService(method string, password string, udpTimeout int64, handler shadowsocks.Handler) (shadowsocks.Service, error) {
+	if method == "none" || method == "plain" || method == "dummy" {
+		return shadowsocks.NewNoneService(udpTimeout, handler), nil
+	} else if common.Contains(shadowstream.List, method) {
+		service, err := shadowstream.NewService(method, nil, password, udpTimeout, handler)
+		if err != nil {
+			return nil, err
+		}
+		return service, nil
+	} else if common.Contains(shadowaead.List, method) {
+		service, err := shadowaead.NewService(method, nil, password, udpTimeout, handler)
+		if err != nil {
+			return nil, err
+		}
+		return service, nil
+	} else if common.Contains(shadowaead_2022.List, method) {
+		return shadowaead_2022.NewServiceWithPassword(method, password, udpTimeout, handler)
+	} else {
+		return nil, E.New("shadowsocks: unsupported method ", method)
+	}
+}
@@ -0,0 +1,114 @@
+package shadowimpl_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowimpl"
+	"github.com/sagernet/sing-shadowsocks/shadowstream"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestFetchService(t *testing.T) {
+	t.Parallel()
+	var methods []string
+	methods = append(methods, "none", "plain", "dummy")
+	methods = append(methods, shadowstream.List...)
+	methods = append(methods, shadowaead.List...)
+	methods = append(methods, shadowaead_2022.List...)
+	for _, method := range methods {
+		password := "password"
+		if method == "2022-blake3-aes-128-gcm" {
+			password = randomPSK(16)
+		} else if strings.HasPrefix(method, "2022-") {
+			password = randomPSK(32)
+		}
+		handler := &fetchHandler{destination: make(chan M.Socksaddr, 1)}
+		service, err := shadowimpl.FetchService(method, password, 500, handler)
+		if err != nil {
+			t.Fatal(method, ": ", err)
+		}
+		client, err := shadowimpl.FetchMethod(method, password)
+		if err != nil {
+			t.Fatal(method, ": ", err)
+		}
+
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			client.DialEarlyConn(clientConn, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+		}()
+		err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		serverConn.Close()
+		clientConn.Close()
+		if err != nil {
+			t.Fatal(method, ": ", err)
+		}
+		if destination := <-handler.destination; destination.String() != "test.com:443" {
+			t.Fatal(method, ": bad destination ", destination)
+		}
+	}
+}
+
+func TestFetchServiceError(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		method   string
+		password string
+		err      error
+	}{
+		{"aes-128-gcm", "", shadowsocks.ErrMissingPassword},
+		{"chacha20-ietf", "", shadowsocks.ErrMissingPassword},
+		{"2022-blake3-aes-128-gcm", randomPSK(8), shadowsocks.ErrBadKey},
+		{"2022-blake3-aes-256-gcm", "", shadowaead_2022.ErrMissingPSK},
+	} {
+		_, err := shadowimpl.FetchService(testCase.method, testCase.password, 500, &fetchHandler{})
+		if !errors.Is(err, testCase.err) {
+			t.Fatal(testCase.method, ": expected ", testCase.err, ", got ", err)
+		}
+	}
+	for _, testCase := range []struct {
+		method   string
+		password string
+	}{
+		{"unknown", "password"},
+		{"2022-blake3-aes-128-gcm", "not base64"},
+	} {
+		_, err := shadowimpl.FetchService(testCase.method, testCase.password, 500, &fetchHandler{})
+		if err == nil {
+			t.Fatal(testCase.method, ": expected error for password ", testCase.password)
+		}
+	}
+}
+
+func randomPSK(length int) string {
+	psk := make([]byte, length)
+	rand.Read(psk)
+	return base64.StdEncoding.EncodeToString(psk)
+}
+
+type fetchHandler struct {
+	destination chan M.Socksaddr
+}
+
+func (h *fetchHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.destination <- metadata.Destination
+	_, err := io.ReadFull(conn, make([]byte, len("hello")))
+	return err
+}
+
+func (h *fetchHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *fetchHandler) NewError(ctx context.Context, err error) {
+}
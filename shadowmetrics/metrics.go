@@ -0,0 +1,196 @@
+package shadowmetrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ shadowsocks.EventHandler = (*Metrics)(nil)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the handshake latency histogram.
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics records metrics of services and exports them in the OpenMetrics text format.
+// Set it as the event handler of services and wrap their handlers with Handler.
+// A Metrics can be shared by multiple services.
+type Metrics struct {
+	access         sync.Mutex
+	handshakes     map[handshakeKey]uint64
+	replays        map[eventKey]uint64
+	timestampSkews map[eventKey]uint64
+	latency        map[string]*histogram
+	tcpConnections map[string]int64
+	udpSessions    map[string]int64
+	traffic        map[trafficKey]*trafficCounter
+}
+
+type handshakeKey struct {
+	method  string
+	network string
+	result  string
+	reason  string
+}
+
+type eventKey struct {
+	method  string
+	network string
+}
+
+type trafficKey struct {
+	method string
+	user   string
+}
+
+type trafficCounter struct {
+	upload   uint64
+	download uint64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func New() *Metrics {
+	return &Metrics{
+		handshakes:     make(map[handshakeKey]uint64),
+		replays:        make(map[eventKey]uint64),
+		timestampSkews: make(map[eventKey]uint64),
+		latency:        make(map[string]*histogram),
+		tcpConnections: make(map[string]int64),
+		udpSessions:    make(map[string]int64),
+		traffic:        make(map[trafficKey]*trafficCounter),
+	}
+}
+
+func (m *Metrics) HandleEvent(ctx context.Context, event shadowsocks.Event) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	switch event.Type {
+	case shadowsocks.EventHandshakeAccepted:
+		m.handshakes[handshakeKey{event.Method, event.Network, "accepted", ""}]++
+		if event.Latency > 0 {
+			m.observeLatency(event.Method, event.Latency.Seconds())
+		}
+	case shadowsocks.EventHandshakeRejected, shadowsocks.EventPacketRejected:
+		m.handshakes[handshakeKey{event.Method, event.Network, "rejected", event.Reason.String()}]++
+	case shadowsocks.EventReplayDetected:
+		m.replays[eventKey{event.Method, event.Network}]++
+	case shadowsocks.EventTimestampSkew:
+		m.timestampSkews[eventKey{event.Method, event.Network}]++
+	}
+}
+
+func (m *Metrics) observeLatency(method string, seconds float64) {
+	h := m.latency[method]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(DefaultLatencyBuckets))}
+		m.latency[method] = h
+	}
+	for i, bound := range DefaultLatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *Metrics) addGauge(gauge map[string]int64, method string, delta int64) {
+	m.access.Lock()
+	gauge[method] += delta
+	m.access.Unlock()
+}
+
+func (m *Metrics) trafficCounter(ctx context.Context, method string) *trafficCounter {
+	key := trafficKey{method: method}
+	if user, loaded := auth.UserFromContext[any](ctx); loaded {
+		key.user = fmt.Sprint(user)
+	}
+	m.access.Lock()
+	defer m.access.Unlock()
+	counter := m.traffic[key]
+	if counter == nil {
+		counter = &trafficCounter{}
+		m.traffic[key] = counter
+	}
+	return counter
+}
+
+// Handler returns a handler that counts active connections, UDP sessions and traffic
+// of the service with method before passing them to handler.
+func (m *Metrics) Handler(method string, handler shadowsocks.Handler) shadowsocks.Handler {
+	return &metricsHandler{handler, m, method}
+}
+
+type metricsHandler struct {
+	shadowsocks.Handler
+	metrics *Metrics
+	method  string
+}
+
+func (h *metricsHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.metrics.addGauge(h.metrics.tcpConnections, h.method, 1)
+	defer h.metrics.addGauge(h.metrics.tcpConnections, h.method, -1)
+	return h.Handler.NewConnection(ctx, &metricsConn{conn, h.metrics.trafficCounter(ctx, h.method)}, metadata)
+}
+
+func (h *metricsHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.metrics.addGauge(h.metrics.udpSessions, h.method, 1)
+	defer h.metrics.addGauge(h.metrics.udpSessions, h.method, -1)
+	return h.Handler.NewPacketConnection(ctx, &metricsPacketConn{conn, h.metrics.trafficCounter(ctx, h.method)}, metadata)
+}
+
+type metricsConn struct {
+	net.Conn
+	counter *trafficCounter
+}
+
+func (c *metricsConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddUint64(&c.counter.upload, uint64(n))
+	return
+}
+
+func (c *metricsConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddUint64(&c.counter.download, uint64(n))
+	return
+}
+
+func (c *metricsConn) Upstream() any {
+	return c.Conn
+}
+
+type metricsPacketConn struct {
+	N.PacketConn
+	counter *trafficCounter
+}
+
+func (c *metricsPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	destination, err := c.PacketConn.ReadPacket(buffer)
+	if err == nil {
+		atomic.AddUint64(&c.counter.upload, uint64(buffer.Len()))
+	}
+	return destination, err
+}
+
+func (c *metricsPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	atomic.AddUint64(&c.counter.download, uint64(buffer.Len()))
+	return c.PacketConn.WritePacket(buffer, destination)
+}
+
+func (c *metricsPacketConn) Upstream() any {
+	return c.PacketConn
+}
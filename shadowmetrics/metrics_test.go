@@ -0,0 +1,90 @@
+package shadowmetrics_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowmetrics"
+	"github.com/sagernet/sing/common/auth"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	metrics := shadowmetrics.New()
+	metrics.HandleEvent(context.Background(), shadowsocks.Event{Type: shadowsocks.EventHandshakeAccepted, Network: N.NetworkTCP, Method: "test", Latency: 2 * time.Millisecond})
+	metrics.HandleEvent(context.Background(), shadowsocks.Event{Type: shadowsocks.EventReplayDetected, Network: N.NetworkTCP, Method: "test"})
+	metrics.HandleEvent(context.Background(), shadowsocks.Event{Type: shadowsocks.EventHandshakeRejected, Network: N.NetworkTCP, Method: "test", Reason: shadowsocks.RejectReasonReplay})
+
+	handler := metrics.Handler("test", &echoHandler{})
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handler.NewConnection(auth.ContextWithUser(context.Background(), "my user"), serverConn, M.Metadata{})
+		close(done)
+	}()
+	_, err := clientConn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(clientConn, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	err = metrics.WriteOpenMetrics(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), `shadowsocks_tcp_connections{method="test"} 1`+"\n") {
+		t.Error("missing active connection in:\n", output.String())
+	}
+	clientConn.Close()
+	<-done
+
+	output.Reset()
+	err = metrics.WriteOpenMetrics(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`shadowsocks_handshakes_total{method="test",network="tcp",result="accepted"} 1`,
+		`shadowsocks_handshakes_total{method="test",network="tcp",result="rejected",reason="replay"} 1`,
+		`shadowsocks_replays_total{method="test",network="tcp"} 1`,
+		`shadowsocks_handshake_duration_seconds_bucket{method="test",le="0.001"} 0`,
+		`shadowsocks_handshake_duration_seconds_bucket{method="test",le="0.005"} 1`,
+		`shadowsocks_handshake_duration_seconds_count{method="test"} 1`,
+		`shadowsocks_tcp_connections{method="test"} 0`,
+		`shadowsocks_traffic_bytes_total{method="test",user="my user",direction="up"} 5`,
+		`shadowsocks_traffic_bytes_total{method="test",user="my user",direction="down"} 5`,
+	} {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Error("missing ", line, " in:\n", output.String())
+		}
+	}
+	if !strings.HasSuffix(output.String(), "# EOF\n") {
+		t.Error("missing EOF")
+	}
+}
+
+type echoHandler struct{}
+
+func (h *echoHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+func (h *echoHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *echoHandler) NewError(ctx context.Context, err error) {
+}
@@ -0,0 +1,170 @@
+package shadowmetrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+var _ http.Handler = (*Metrics)(nil)
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	m.WriteOpenMetrics(w)
+}
+
+// WriteOpenMetrics writes all metrics in the OpenMetrics text format.
+func (m *Metrics) WriteOpenMetrics(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	m.access.Lock()
+
+	writeFamily(writer, "shadowsocks_handshakes", "counter", "Handshakes by method, network and result.")
+	handshakeKeys := make([]handshakeKey, 0, len(m.handshakes))
+	for key := range m.handshakes {
+		handshakeKeys = append(handshakeKeys, key)
+	}
+	sort.Slice(handshakeKeys, func(i, j int) bool {
+		a, b := handshakeKeys[i], handshakeKeys[j]
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		if a.network != b.network {
+			return a.network < b.network
+		}
+		if a.result != b.result {
+			return a.result < b.result
+		}
+		return a.reason < b.reason
+	})
+	for _, key := range handshakeKeys {
+		labels := []string{"method", key.method, "network", key.network, "result", key.result}
+		if key.reason != "" {
+			labels = append(labels, "reason", key.reason)
+		}
+		writeSample(writer, "shadowsocks_handshakes_total", labels, formatUint(m.handshakes[key]))
+	}
+
+	writeFamily(writer, "shadowsocks_replays", "counter", "Requests rejected by the replay filter.")
+	writeEventCounters(writer, "shadowsocks_replays_total", m.replays)
+	writeFamily(writer, "shadowsocks_timestamp_skews", "counter", "Requests rejected for a timestamp out of range.")
+	writeEventCounters(writer, "shadowsocks_timestamp_skews_total", m.timestampSkews)
+
+	writeFamily(writer, "shadowsocks_handshake_duration_seconds", "histogram", "Latency of accepted handshakes.")
+	for _, method := range sortedKeys(m.latency) {
+		h := m.latency[method]
+		var cumulative uint64
+		for i, bound := range DefaultLatencyBuckets {
+			cumulative += h.counts[i]
+			writeSample(writer, "shadowsocks_handshake_duration_seconds_bucket", []string{"method", method, "le", formatFloat(bound)}, formatUint(cumulative))
+		}
+		writeSample(writer, "shadowsocks_handshake_duration_seconds_bucket", []string{"method", method, "le", "+Inf"}, formatUint(h.count))
+		writeSample(writer, "shadowsocks_handshake_duration_seconds_sum", []string{"method", method}, formatFloat(h.sum))
+		writeSample(writer, "shadowsocks_handshake_duration_seconds_count", []string{"method", method}, formatUint(h.count))
+	}
+
+	writeFamily(writer, "shadowsocks_tcp_connections", "gauge", "Active TCP connections.")
+	for _, method := range sortedKeys(m.tcpConnections) {
+		writeSample(writer, "shadowsocks_tcp_connections", []string{"method", method}, strconv.FormatInt(m.tcpConnections[method], 10))
+	}
+	writeFamily(writer, "shadowsocks_udp_sessions", "gauge", "Active UDP sessions.")
+	for _, method := range sortedKeys(m.udpSessions) {
+		writeSample(writer, "shadowsocks_udp_sessions", []string{"method", method}, strconv.FormatInt(m.udpSessions[method], 10))
+	}
+
+	writeFamily(writer, "shadowsocks_traffic_bytes", "counter", "Payload bytes by method, user and direction.")
+	trafficKeys := make([]trafficKey, 0, len(m.traffic))
+	for key := range m.traffic {
+		trafficKeys = append(trafficKeys, key)
+	}
+	sort.Slice(trafficKeys, func(i, j int) bool {
+		a, b := trafficKeys[i], trafficKeys[j]
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.user < b.user
+	})
+	for _, key := range trafficKeys {
+		counter := m.traffic[key]
+		labels := []string{"method", key.method}
+		if key.user != "" {
+			labels = append(labels, "user", key.user)
+		}
+		writeSample(writer, "shadowsocks_traffic_bytes_total", append(labels, "direction", "up"), formatUint(atomic.LoadUint64(&counter.upload)))
+		writeSample(writer, "shadowsocks_traffic_bytes_total", append(labels, "direction", "down"), formatUint(atomic.LoadUint64(&counter.download)))
+	}
+
+	m.access.Unlock()
+	writer.WriteString("# EOF\n")
+	return writer.Flush()
+}
+
+func writeEventCounters(writer *bufio.Writer, name string, counters map[eventKey]uint64) {
+	keys := make([]eventKey, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].network < keys[j].network
+	})
+	for _, key := range keys {
+		writeSample(writer, name, []string{"method", key.method, "network", key.network}, formatUint(counters[key]))
+	}
+}
+
+func writeFamily(writer *bufio.Writer, name string, metricType string, help string) {
+	writer.WriteString("# TYPE " + name + " " + metricType + "\n")
+	writer.WriteString("# HELP " + name + " " + help + "\n")
+}
+
+// writeSample writes a sample line, labels is a list of name and value pairs.
+func writeSample(writer *bufio.Writer, name string, labels []string, value string) {
+	writer.WriteString(name)
+	if len(labels) > 0 {
+		writer.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				writer.WriteByte(',')
+			}
+			writer.WriteString(labels[i])
+			writer.WriteString(`="`)
+			writer.WriteString(labelEscaper.Replace(labels[i+1]))
+			writer.WriteByte('"')
+		}
+		writer.WriteByte('}')
+	}
+	writer.WriteByte(' ')
+	writer.WriteString(value)
+	writer.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatUint(value uint64) string {
+	return strconv.FormatUint(value, 10)
+}
+
+func formatFloat(value float64) string {
+	s := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
@@ -0,0 +1,157 @@
+package shadowmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/rw"
+)
+
+// each stream starts with a request from the client: big endian flags and the destination.
+// The server answers with a status before its first data, followed by a varint length
+// prefixed message if it is an error.
+const (
+	flagUDP = 1
+
+	statusSuccess = 0
+	statusError   = 1
+)
+
+var ErrUDPStream = E.New("mux: udp streams are not supported")
+
+// Destination is the destination of shadowsocks connections carrying a mux session.
+var Destination = M.Socksaddr{Fqdn: MagicAddress, Port: 444}
+
+// RemoteError is returned by the first read of a client stream rejected by the server.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "mux: remote error: " + e.Message
+}
+
+// WriteStreamRequest writes the request of a TCP stream to destination.
+func WriteStreamRequest(stream net.Conn, destination M.Socksaddr) error {
+	buffer := buf.NewSize(2 + M.SocksaddrSerializer.AddrPortLen(destination))
+	defer buffer.Release()
+	err := binary.Write(buffer, binary.BigEndian, uint16(0))
+	if err != nil {
+		return err
+	}
+	err = M.SocksaddrSerializer.WriteAddrPort(buffer, destination)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(buffer.Bytes())
+	return err
+}
+
+// ReadStreamRequest reads the request of a stream, UDP streams are rejected with ErrUDPStream.
+func ReadStreamRequest(stream net.Conn) (M.Socksaddr, error) {
+	var flags uint16
+	err := binary.Read(stream, binary.BigEndian, &flags)
+	if err != nil {
+		return M.Socksaddr{}, E.Cause(err, "read mux stream flags")
+	}
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(stream)
+	if err != nil {
+		return M.Socksaddr{}, E.Cause(err, "read mux stream destination")
+	}
+	if flags&flagUDP != 0 {
+		return destination, ErrUDPStream
+	}
+	return destination, nil
+}
+
+// RejectStream writes the error status to a stream before any data.
+func RejectStream(stream net.Conn, cause error) error {
+	message := cause.Error()
+	var response bytes.Buffer
+	response.WriteByte(statusError)
+	rw.WriteVString(&response, message)
+	_, err := stream.Write(response.Bytes())
+	return err
+}
+
+// ServerConn writes the success status of a stream with its first write.
+type ServerConn struct {
+	net.Conn
+	responseWritten bool
+}
+
+func NewServerConn(stream net.Conn) *ServerConn {
+	return &ServerConn{Conn: stream}
+}
+
+func (c *ServerConn) Write(p []byte) (n int, err error) {
+	if c.responseWritten {
+		return c.Conn.Write(p)
+	}
+	response := make([]byte, 1+len(p))
+	response[0] = statusSuccess
+	copy(response[1:], p)
+	_, err = c.Conn.Write(response)
+	if err != nil {
+		return
+	}
+	c.responseWritten = true
+	return len(p), nil
+}
+
+func (c *ServerConn) Upstream() any {
+	return c.Conn
+}
+
+// ClientConn reads the status of a stream with its first read.
+type ClientConn struct {
+	net.Conn
+	responseRead bool
+	responseErr  error
+}
+
+func NewClientConn(stream net.Conn) *ClientConn {
+	return &ClientConn{Conn: stream}
+}
+
+func (c *ClientConn) Read(p []byte) (n int, err error) {
+	if !c.responseRead {
+		err = c.readResponse()
+		if err != nil {
+			return
+		}
+	}
+	if c.responseErr != nil {
+		return 0, c.responseErr
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *ClientConn) readResponse() error {
+	status, err := rw.ReadByte(c.Conn)
+	if err != nil {
+		return err
+	}
+	c.responseRead = true
+	switch status {
+	case statusSuccess:
+	case statusError:
+		message, err := rw.ReadVString(c.Conn)
+		if err != nil {
+			c.responseErr = E.Cause(err, "read mux stream error")
+		} else {
+			c.responseErr = &RemoteError{message}
+		}
+	default:
+		c.responseErr = E.Extend(ErrBadFrame, "stream status ", status)
+	}
+	return nil
+}
+
+func (c *ClientConn) Upstream() any {
+	return c.Conn
+}
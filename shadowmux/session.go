@@ -0,0 +1,332 @@
+package shadowmux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/rw"
+)
+
+const (
+	// MagicAddress is the destination of shadowsocks connections carrying a mux session,
+	// the same as sing-mux so sessions interoperate with sing-mux peers using smux.
+	MagicAddress = "sp.mux.sing-box.arpa"
+
+	// MaxFrameSize is the maximum payload length of a frame.
+	MaxFrameSize = 32768
+	// MaxStreamBuffer is the maximum length of data received but not read by a stream,
+	// a stream exceeding it is reset so it never blocks the other streams of the session.
+	MaxStreamBuffer = 1024 * 1024
+	// MaxReceiveBuffer is the maximum length of data received but not read by the streams of a session,
+	// the stream with the most unread data is reset when it is exceeded.
+	MaxReceiveBuffer = 4 * 1024 * 1024
+
+	frameVersion  = 1
+	headerSize    = 8
+	acceptBacklog = 1024
+)
+
+// frames follow smux version 1: version, command, little endian payload length and stream id.
+const (
+	cmdSYN byte = iota
+	cmdFIN
+	cmdPSH
+	cmdNOP
+)
+
+// the preface is written by the client once before any frame: mux version and protocol,
+// 0 for smux. Version 1 adds a padding flag, padded sessions are not supported.
+const (
+	version0     = 0
+	version1     = 1
+	protocolSmux = 0
+)
+
+var preface = []byte{version0, protocolSmux}
+
+var (
+	ErrBadPreface        = E.New("mux: bad preface")
+	ErrPadding           = E.New("mux: padding is not supported")
+	ErrBadFrame          = E.New("mux: bad frame")
+	ErrSessionClosed     = E.New("mux: session closed")
+	ErrStreamIDExhausted = E.New("mux: stream id exhausted")
+	ErrStreamReset       = E.New("mux: stream reset, receive buffer exceeded")
+)
+
+// Session carries streams over a connection, a Session created by NewClient opens streams
+// which are accepted by the Session created by NewServer on the other side.
+type Session struct {
+	conn        net.Conn
+	writeAccess sync.Mutex
+
+	access   sync.Mutex
+	buffered int
+	nextID   uint32
+	streams  map[uint32]*Stream
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// NewClient writes the preface to conn and starts the session.
+func NewClient(conn net.Conn) (*Session, error) {
+	_, err := conn.Write(preface)
+	if err != nil {
+		return nil, E.Cause(err, "write mux preface")
+	}
+	return newSession(conn, 1), nil
+}
+
+// NewServer reads the preface from conn and starts the session.
+func NewServer(conn net.Conn) (*Session, error) {
+	var request [2]byte
+	_, err := io.ReadFull(conn, request[:])
+	if err != nil {
+		return nil, E.Cause(err, "read mux preface")
+	}
+	version, protocol := request[0], request[1]
+	if version > version1 || protocol != protocolSmux {
+		return nil, E.Extend(ErrBadPreface, "version ", version, ", protocol ", protocol)
+	}
+	if version == version1 {
+		padding, err := rw.ReadByte(conn)
+		if err != nil {
+			return nil, E.Cause(err, "read mux preface")
+		}
+		if padding != 0 {
+			return nil, ErrPadding
+		}
+	}
+	return newSession(conn, 2), nil
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		nextID:  firstID,
+		streams: make(map[uint32]*Stream),
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go s.loopInput()
+	return s
+}
+
+// OpenStream opens a new stream.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.access.Lock()
+	if s.IsClosed() {
+		s.access.Unlock()
+		return nil, s.err
+	}
+	if s.nextID > math.MaxUint32-2 {
+		s.access.Unlock()
+		return nil, ErrStreamIDExhausted
+	}
+	stream := newStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.access.Unlock()
+	err := s.writeFrame(cmdSYN, stream.id, nil)
+	if err != nil {
+		s.removeStream(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for a stream opened by the other side.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return len(s.streams)
+}
+
+// Done is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the connection and all streams.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.access.Lock()
+		s.err = err
+		close(s.done)
+		s.access.Unlock()
+		s.conn.Close()
+	})
+}
+
+func (s *Session) loopInput() {
+	var header [headerSize]byte
+	for {
+		_, err := io.ReadFull(s.conn, header[:])
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if header[0] != frameVersion {
+			s.closeWithError(E.Extend(ErrBadFrame, "version ", header[0]))
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(header[2:]))
+		id := binary.LittleEndian.Uint32(header[4:])
+		switch header[1] {
+		case cmdSYN:
+			s.access.Lock()
+			_, loaded := s.streams[id]
+			var stream *Stream
+			if !loaded {
+				stream = newStream(s, id)
+				s.streams[id] = stream
+			}
+			s.access.Unlock()
+			if stream != nil {
+				select {
+				case s.accept <- stream:
+				case <-s.done:
+					return
+				}
+			}
+		case cmdFIN:
+			stream := s.stream(id)
+			if stream != nil {
+				stream.closeRemote()
+			}
+		case cmdPSH:
+			if length == 0 {
+				break
+			}
+			data := make([]byte, length)
+			_, err = io.ReadFull(s.conn, data)
+			if err != nil {
+				s.closeWithError(err)
+				return
+			}
+			stream := s.stream(id)
+			if stream == nil || !s.reserve(stream, length) {
+				break
+			}
+			if !stream.push(data) {
+				s.release(stream, length)
+			}
+			continue
+		case cmdNOP:
+		default:
+			s.closeWithError(E.Extend(ErrBadFrame, "command ", header[1]))
+			return
+		}
+		if header[1] != cmdPSH && length > 0 {
+			_, err = io.CopyN(io.Discard, s.conn, int64(length))
+			if err != nil {
+				s.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.access.Lock()
+	delete(s.streams, id)
+	s.access.Unlock()
+}
+
+// reserve accounts n bytes received for stream. Instead of blocking the session, a stream
+// exceeding MaxStreamBuffer is reset, and when the session exceeds MaxReceiveBuffer the
+// stream with the most unread data is reset.
+func (s *Session) reserve(stream *Stream, n int) bool {
+	s.access.Lock()
+	if stream.buffered+n > MaxStreamBuffer {
+		s.access.Unlock()
+		stream.reset()
+		return false
+	}
+	var slowest *Stream
+	if s.buffered+n > MaxReceiveBuffer {
+		for _, other := range s.streams {
+			if slowest == nil || other.buffered > slowest.buffered {
+				slowest = other
+			}
+		}
+	}
+	if slowest == stream {
+		s.access.Unlock()
+		stream.reset()
+		return false
+	}
+	stream.buffered += n
+	s.buffered += n
+	s.access.Unlock()
+	if slowest != nil {
+		slowest.reset()
+	}
+	return true
+}
+
+// release frees n bytes of the receive buffer of stream after they are read or dropped.
+func (s *Session) release(stream *Stream, n int) {
+	if n == 0 {
+		return
+	}
+	s.access.Lock()
+	stream.buffered -= n
+	s.buffered -= n
+	s.access.Unlock()
+}
+
+func (s *Session) writeFrame(command byte, id uint32, payload []byte) error {
+	if s.IsClosed() {
+		return s.err
+	}
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = frameVersion
+	frame[1] = command
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	copy(frame[headerSize:], payload)
+	s.writeAccess.Lock()
+	_, err := s.conn.Write(frame)
+	s.writeAccess.Unlock()
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
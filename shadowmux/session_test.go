@@ -0,0 +1,225 @@
+package shadowmux_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks/shadowmux"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func newSessions(t *testing.T) (*shadowmux.Session, *shadowmux.Session) {
+	serverConn, clientConn := net.Pipe()
+	serverDone := make(chan *shadowmux.Session)
+	go func() {
+		server, err := shadowmux.NewServer(serverConn)
+		if err != nil {
+			t.Error(err)
+		}
+		serverDone <- server
+	}()
+	client, err := shadowmux.NewClient(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-serverDone
+	if server == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestSessionEcho(t *testing.T) {
+	t.Parallel()
+	client, server := newSessions(t)
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+			data := make([]byte, 3*shadowmux.MaxFrameSize+100)
+			rand.Read(data)
+			go stream.Write(data)
+			response := make([]byte, len(data))
+			_, err = io.ReadFull(stream, response)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(data, response) {
+				t.Error("bad echo")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamCloseAndDeadline(t *testing.T) {
+	t.Parallel()
+	client, server := newSessions(t)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverStream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got ", err)
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	_, err = serverStream.Write([]byte("bye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverStream.Close()
+	response, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "bye" {
+		t.Fatal("bad response ", string(response))
+	}
+	stream.Close()
+	for i := 0; client.NumStreams() > 0 || server.NumStreams() > 0; i++ {
+		if i == 100 {
+			t.Fatal("streams not removed after close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamRequest(t *testing.T) {
+	t.Parallel()
+	client, server := newSessions(t)
+	go func() {
+		for i := 0; i < 2; i++ {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			destination, err := shadowmux.ReadStreamRequest(stream)
+			if i == 0 {
+				if err != nil || destination.String() != "example.com:443" {
+					t.Error("bad request ", destination, " ", err)
+				}
+				shadowmux.RejectStream(stream, errors.New("rejected"))
+			} else if !errors.Is(err, shadowmux.ErrUDPStream) {
+				t.Error("expected udp stream rejected, got ", err)
+			}
+			stream.Close()
+		}
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = shadowmux.WriteStreamRequest(stream, M.ParseSocksaddr("example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = shadowmux.NewClientConn(stream).Read(make([]byte, 1))
+	var remoteErr *shadowmux.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != "rejected" {
+		t.Fatal("expected remote error, got ", err)
+	}
+
+	// flags with the udp bit set, then the destination 1.1.1.1:53
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Write([]byte{0, 1, 1, 1, 1, 1, 1, 0, 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, stream)
+}
+
+func TestStreamReset(t *testing.T) {
+	t.Parallel()
+	client, server := newSessions(t)
+	accepted := make(chan *shadowmux.Stream, 8)
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			accepted <- stream
+		}
+	}()
+
+	// a stream not read by the server is reset instead of blocking the session
+	slowStream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowServerStream := <-accepted
+	_, err = slowStream.Write(make([]byte, shadowmux.MaxStreamBuffer+shadowmux.MaxFrameSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverStream := <-accepted
+	go io.Copy(serverStream, serverStream)
+	_, err = stream.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	_, err = io.ReadFull(stream, response)
+	if err != nil || string(response) != "ping" {
+		t.Fatal("bad response ", string(response), " ", err)
+	}
+
+	_, err = slowServerStream.Read(response)
+	if !errors.Is(err, shadowmux.ErrStreamReset) {
+		t.Fatal("expected stream reset, got ", err)
+	}
+	_, err = slowStream.Read(response)
+	if err != io.EOF {
+		t.Fatal("expected FIN from the reset stream, got ", err)
+	}
+}
@@ -0,0 +1,240 @@
+package shadowmux
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = (*Stream)(nil)
+
+// Stream is a logical connection of a Session.
+type Stream struct {
+	session *Session
+	id      uint32
+
+	// buffered is the length of unread data, guarded by the access of the session
+	buffered int
+
+	access        sync.Mutex
+	buffers       [][]byte
+	localClosed   bool
+	remoteClosed  bool
+	isReset       bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readEvent     chan struct{}
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		session:   session,
+		id:        id,
+		readEvent: make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) Read(p []byte) (n int, err error) {
+	for {
+		s.access.Lock()
+		if s.localClosed {
+			s.access.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if s.isReset {
+			s.access.Unlock()
+			return 0, ErrStreamReset
+		}
+		if len(s.buffers) > 0 {
+			n = copy(p, s.buffers[0])
+			s.buffers[0] = s.buffers[0][n:]
+			if len(s.buffers[0]) == 0 {
+				s.buffers[0] = nil
+				s.buffers = s.buffers[1:]
+			}
+			s.access.Unlock()
+			s.session.release(s, n)
+			return n, nil
+		}
+		if s.remoteClosed {
+			s.access.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.access.Unlock()
+		if s.session.IsClosed() {
+			return 0, s.session.err
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-s.readEvent:
+		case <-s.session.done:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write writes p in frames of up to MaxFrameSize bytes.
+func (s *Stream) Write(p []byte) (n int, err error) {
+	s.access.Lock()
+	closed := s.localClosed
+	isReset := s.isReset
+	deadline := s.writeDeadline
+	s.access.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if isReset {
+		return 0, ErrStreamReset
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		err = s.session.writeFrame(cmdPSH, s.id, chunk)
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return
+}
+
+// Close sends FIN to the other side and drops data not read yet.
+func (s *Stream) Close() error {
+	s.access.Lock()
+	if s.localClosed {
+		s.access.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	unread := s.dropLocked()
+	remoteClosed := s.remoteClosed
+	isReset := s.isReset
+	s.access.Unlock()
+	s.session.release(s, unread)
+	s.notifyRead()
+	if remoteClosed {
+		s.session.removeStream(s.id)
+	}
+	if s.session.IsClosed() {
+		s.session.removeStream(s.id)
+		return nil
+	}
+	if isReset {
+		// FIN is already sent
+		return nil
+	}
+	return s.session.writeFrame(cmdFIN, s.id, nil)
+}
+
+// reset drops the unread data of a stream exceeding the receive buffer and sends FIN,
+// further data is dropped and reads and writes fail with ErrStreamReset.
+func (s *Stream) reset() {
+	s.access.Lock()
+	if s.localClosed || s.isReset {
+		s.access.Unlock()
+		return
+	}
+	s.isReset = true
+	unread := s.dropLocked()
+	remoteClosed := s.remoteClosed
+	s.access.Unlock()
+	s.session.release(s, unread)
+	s.notifyRead()
+	if remoteClosed {
+		s.session.removeStream(s.id)
+	}
+	// called by the input loop, which must not wait for the connection to be writable
+	go s.session.writeFrame(cmdFIN, s.id, nil)
+}
+
+func (s *Stream) dropLocked() int {
+	var unread int
+	for _, buffer := range s.buffers {
+		unread += len(buffer)
+	}
+	s.buffers = nil
+	return unread
+}
+
+func (s *Stream) push(data []byte) bool {
+	s.access.Lock()
+	if s.localClosed || s.isReset {
+		s.access.Unlock()
+		return false
+	}
+	s.buffers = append(s.buffers, data)
+	s.access.Unlock()
+	s.notifyRead()
+	return true
+}
+
+func (s *Stream) closeRemote() {
+	s.access.Lock()
+	s.remoteClosed = true
+	localClosed := s.localClosed || s.isReset
+	s.access.Unlock()
+	s.notifyRead()
+	if localClosed {
+		s.session.removeStream(s.id)
+	}
+}
+
+func (s *Stream) notifyRead() {
+	select {
+	case s.readEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.access.Lock()
+	s.readDeadline = t
+	s.access.Unlock()
+	s.notifyRead()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future writes, a write already blocked
+// on the connection is not interrupted.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.access.Lock()
+	s.writeDeadline = t
+	s.access.Unlock()
+	return nil
+}
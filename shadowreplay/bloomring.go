@@ -0,0 +1,135 @@
+package shadowreplay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/replay"
+)
+
+const (
+	DefaultCapacity          = 1e6
+	DefaultFalsePositiveRate = 1e-6
+)
+
+var _ replay.Filter = (*BloomRing)(nil)
+
+// BloomRing is a pair of bloom filters that are rotated when the current one
+// reaches its capacity or outlives its lifetime, so entries are remembered for
+// at least one full generation.
+type BloomRing struct {
+	access   sync.Mutex
+	capacity int
+	lifetime time.Duration
+	seed     [2]uint64
+	current  *bloomFilter
+	previous *bloomFilter
+	count    int
+	rotated  time.Time
+}
+
+// NewBloomRing creates a filter holding up to capacity entries per generation.
+// If lifetime is positive, generations are also rotated after that duration.
+// The filters are allocated on first use, as the default capacity takes several megabytes.
+func NewBloomRing(capacity int, lifetime time.Duration) *BloomRing {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	f := &BloomRing{
+		capacity: capacity,
+		lifetime: lifetime,
+		rotated:  time.Now(),
+	}
+	common.Must(binary.Read(rand.Reader, binary.BigEndian, &f.seed))
+	return f
+}
+
+func (f *BloomRing) Check(sum []byte) bool {
+	h1, h2 := f.hash(sum)
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.current == nil {
+		f.current = newBloomFilter(f.capacity, DefaultFalsePositiveRate)
+	}
+	if f.current.test(h1, h2) || f.previous != nil && f.previous.test(h1, h2) {
+		return false
+	}
+	if f.count >= f.capacity || f.lifetime > 0 && time.Since(f.rotated) >= f.lifetime {
+		f.current, f.previous = f.previous, f.current
+		if f.current == nil {
+			f.current = newBloomFilter(f.capacity, DefaultFalsePositiveRate)
+		} else {
+			f.current.reset()
+		}
+		f.count = 0
+		f.rotated = time.Now()
+	}
+	f.current.add(h1, h2)
+	f.count++
+	return true
+}
+
+func (f *BloomRing) hash(sum []byte) (uint64, uint64) {
+	const prime = 1099511628211
+	h1 := 14695981039346656037 ^ f.seed[0]
+	h2 := 14695981039346656037 ^ f.seed[1]
+	for _, b := range sum {
+		h1 = (h1 ^ uint64(b)) * prime
+		h2 = (h2 ^ uint64(b)) * prime
+	}
+	return h1, h2 | 1
+}
+
+// mix is the murmur3 finalizer, without it FNV based double hashing sets correlated bits
+// and the false positive rate is far above the configured one.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	size := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Ceil(size / float64(capacity) * math.Ln2))
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(size)+63)/64),
+		size:   uint64(size),
+		hashes: hashes,
+	}
+}
+
+func (f *bloomFilter) test(h1, h2 uint64) bool {
+	for i := 0; i < f.hashes; i++ {
+		bit := mix(h1+uint64(i)*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(h1, h2 uint64) {
+	for i := 0; i < f.hashes; i++ {
+		bit := mix(h1+uint64(i)*h2) % f.size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
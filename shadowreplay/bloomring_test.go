@@ -0,0 +1,70 @@
+package shadowreplay_test
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/shadowreplay"
+)
+
+func TestBloomRing(t *testing.T) {
+	t.Parallel()
+	filter := shadowreplay.NewBloomRing(100, 0)
+	salts := make([][]byte, 250)
+	for i := range salts {
+		salts[i] = make([]byte, 32)
+		rand.Read(salts[i])
+		if !filter.Check(salts[i]) {
+			t.Fatal("fresh salt rejected")
+		}
+		if filter.Check(salts[i]) {
+			t.Fatal("replayed salt accepted")
+		}
+	}
+	for _, salt := range salts[len(salts)-100:] {
+		if filter.Check(salt) {
+			t.Fatal("salt in previous generation accepted")
+		}
+	}
+	if !filter.Check(salts[0]) {
+		t.Fatal("expired salt rejected")
+	}
+}
+
+func TestBloomRingFalsePositiveRate(t *testing.T) {
+	t.Parallel()
+	const entries = 100000
+	filter := shadowreplay.NewBloomRing(2*entries, 0)
+	// sequential salts differ in a few bytes only and must be spread like random ones
+	salt := make([]byte, 32)
+	for i := 0; i < entries; i++ {
+		binary.BigEndian.PutUint64(salt[24:], uint64(i))
+		filter.Check(salt)
+	}
+	var falsePositives int
+	for i := entries; i < 2*entries; i++ {
+		binary.BigEndian.PutUint64(salt[24:], uint64(i))
+		if !filter.Check(salt) {
+			falsePositives++
+		}
+	}
+	// the configured rate expects no false positive at all
+	if falsePositives > 10 {
+		t.Fatal("too many false positives: ", falsePositives)
+	}
+}
+
+func TestBloomRingLazyAllocation(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	filter := shadowreplay.NewBloomRing(0, 0)
+	runtime.ReadMemStats(&after)
+	if after.TotalAlloc-before.TotalAlloc > 1<<20 {
+		t.Fatal("filters allocated before first use")
+	}
+	if !filter.Check(make([]byte, 32)) {
+		t.Fatal("fresh salt rejected")
+	}
+}
@@ -0,0 +1,266 @@
+package shadowreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/replay"
+)
+
+var _ replay.Filter = (*FileFilter)(nil)
+
+var fileMagic = []byte("ssreplay1\n")
+
+var ErrBadFile = E.New("bad replay filter file")
+
+// FileFilter is a replay filter backed by an append-only log file, salts checked within
+// the window are loaded again when the file is reopened after a restart. The log is
+// compacted in the background every window to drop expired salts.
+//
+// Salts are written to the file without syncing, so they survive process restarts but
+// may be lost on power failure.
+type FileFilter struct {
+	access        sync.Mutex
+	compactAccess sync.Mutex
+	compactGroup  sync.WaitGroup
+	path          string
+	window        time.Duration
+	file          *os.File
+	closed        bool
+	salts         map[string]int64
+	compacted     time.Time
+	compacting    bool
+	pending       [][]byte
+	errorHandler  func(err error)
+	err           error
+}
+
+// OpenFileFilter loads the filter from path, creating the file if it does not exist.
+func OpenFileFilter(path string, window time.Duration) (*FileFilter, error) {
+	if window <= 0 {
+		return nil, os.ErrInvalid
+	}
+	f := &FileFilter{
+		path:   path,
+		window: window,
+		salts:  make(map[string]int64),
+	}
+	file, err := os.Open(path)
+	if err == nil {
+		err = f.load(file)
+		file.Close()
+		if err != nil {
+			return nil, E.Cause(err, "load ", path)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = f.compact(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileFilter) load(reader io.Reader) error {
+	bufReader := bufio.NewReader(reader)
+	magic := make([]byte, len(fileMagic))
+	_, err := io.ReadFull(bufReader, magic)
+	if err == io.EOF {
+		return nil
+	} else if err != nil || !bytes.Equal(magic, fileMagic) {
+		return ErrBadFile
+	}
+	now := time.Now().UnixNano()
+	var header [9]byte
+	for {
+		_, err = io.ReadFull(bufReader, header[:])
+		if err != nil {
+			// a truncated record is left by an interrupted write
+			break
+		}
+		seen := int64(binary.BigEndian.Uint64(header[:8]))
+		salt := make([]byte, header[8])
+		_, err = io.ReadFull(bufReader, salt)
+		if err != nil {
+			break
+		}
+		if now-seen < int64(f.window) {
+			f.salts[string(salt)] = seen
+		}
+	}
+	return nil
+}
+
+// SetErrorHandler sets the handler of errors writing or compacting the file, which are
+// otherwise only returned by Close. Salts are still checked in memory after an error.
+func (f *FileFilter) SetErrorHandler(handler func(err error)) {
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.errorHandler = handler
+}
+
+func (f *FileFilter) Check(sum []byte) bool {
+	if len(sum) > 255 {
+		return false
+	}
+	now := time.Now()
+	f.access.Lock()
+	if seen, loaded := f.salts[string(sum)]; loaded && now.UnixNano()-seen < int64(f.window) {
+		f.access.Unlock()
+		return false
+	}
+	f.salts[string(sum)] = now.UnixNano()
+	if f.closed {
+		f.access.Unlock()
+		return true
+	}
+	record := newRecord(sum, now.UnixNano())
+	_, err := f.file.Write(record)
+	if f.compacting {
+		// the file is being replaced, the record is written to the new one as well
+		f.pending = append(f.pending, record)
+	} else if now.Sub(f.compacted) >= f.window {
+		f.compacting = true
+		f.compactGroup.Add(1)
+		go func() {
+			defer f.compactGroup.Done()
+			f.reportErr(f.compact(now))
+		}()
+	}
+	f.access.Unlock()
+	f.reportErr(err)
+	return true
+}
+
+// Compact rewrites the file with the salts within the window.
+func (f *FileFilter) Compact() error {
+	return f.compact(time.Now())
+}
+
+func (f *FileFilter) compact(now time.Time) error {
+	f.compactAccess.Lock()
+	defer f.compactAccess.Unlock()
+	f.access.Lock()
+	// a compaction started before Close is completed
+	if f.closed && f.file == nil {
+		f.compacting = false
+		f.access.Unlock()
+		return os.ErrClosed
+	}
+	f.compacting = true
+	f.compacted = now
+	f.pending = nil
+	salts := make(map[string]int64, len(f.salts))
+	for salt, seen := range f.salts {
+		if now.UnixNano()-seen >= int64(f.window) {
+			delete(f.salts, salt)
+		} else {
+			salts[salt] = seen
+		}
+	}
+	f.access.Unlock()
+
+	tmpPath := f.path + ".tmp"
+	tmpFile, err := f.writeSalts(tmpPath, salts)
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.compacting = false
+	pending := f.pending
+	f.pending = nil
+	if err != nil {
+		return err
+	}
+	for _, record := range pending {
+		_, err = tmpFile.Write(record)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, f.path)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = tmpFile
+	return nil
+}
+
+// writeSalts writes and syncs a new log to path, it returns the file open for appending.
+func (f *FileFilter) writeSalts(path string, salts map[string]int64) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	writer.Write(fileMagic)
+	for salt, seen := range salts {
+		writer.Write(newRecord([]byte(salt), seen))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *FileFilter) reportErr(err error) {
+	if err == nil {
+		return
+	}
+	f.access.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	errorHandler := f.errorHandler
+	f.access.Unlock()
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
+
+// Close waits for a running compaction and closes the file, it returns the first error of
+// writing or compacting the file if any.
+func (f *FileFilter) Close() error {
+	f.access.Lock()
+	f.closed = true
+	f.access.Unlock()
+	f.compactGroup.Wait()
+	f.compactAccess.Lock()
+	defer f.compactAccess.Unlock()
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.file != nil {
+		err := f.file.Close()
+		if err != nil && f.err == nil {
+			f.err = err
+		}
+		f.file = nil
+	}
+	return f.err
+}
+
+func newRecord(salt []byte, seen int64) []byte {
+	record := make([]byte, 9+len(salt))
+	binary.BigEndian.PutUint64(record, uint64(seen))
+	record[8] = byte(len(salt))
+	copy(record[9:], salt)
+	return record
+}
@@ -0,0 +1,271 @@
+package shadowreplay_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowreplay"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestFileFilter(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "replay")
+	filter, err := shadowreplay.OpenFileFilter(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salts := make([][]byte, 100)
+	for i := range salts {
+		salts[i] = make([]byte, 32)
+		rand.Read(salts[i])
+		if !filter.Check(salts[i]) {
+			t.Fatal("fresh salt rejected")
+		}
+	}
+	err = filter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a write interrupted by a crash
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3})
+	file.Close()
+
+	filter, err = shadowreplay.OpenFileFilter(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Close()
+	for _, salt := range salts {
+		if filter.Check(salt) {
+			t.Fatal("salt checked before restart accepted")
+		}
+	}
+	err = filter.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := make([]byte, 32)
+	rand.Read(fresh)
+	if !filter.Check(fresh) {
+		t.Fatal("fresh salt rejected")
+	}
+}
+
+func TestFileFilterExpire(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "replay")
+	filter, err := shadowreplay.OpenFileFilter(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	filter.Check(salt)
+	filter.Close()
+	time.Sleep(100 * time.Millisecond)
+	filter, err = shadowreplay.OpenFileFilter(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Close()
+	if !filter.Check(salt) {
+		t.Fatal("expired salt rejected")
+	}
+}
+
+func TestFileFilterBackgroundCompaction(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "replay")
+	filter, err := shadowreplay.OpenFileFilter(path, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salts := make([][]byte, 3)
+	for i := range salts {
+		salts[i] = make([]byte, 32)
+		rand.Read(salts[i])
+	}
+	filter.Check(salts[0])
+	time.Sleep(250 * time.Millisecond)
+	// the first salt expired, the second one starts a compaction
+	filter.Check(salts[1])
+	filter.Check(salts[2])
+	err = filter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := int64(len("ssreplay1\n") + 2*(9+32)); info.Size() != expected {
+		t.Fatal("expected compacted file of ", expected, " bytes, got ", info.Size())
+	}
+	filter, err = shadowreplay.OpenFileFilter(path, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Close()
+	if filter.Check(salts[1]) || filter.Check(salts[2]) {
+		t.Fatal("salt checked during compaction lost")
+	}
+}
+
+func TestFileFilterCompactionError(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "replay")
+	filter, err := shadowreplay.OpenFileFilter(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	filter.SetErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	// the temporary file of the compaction can not be created
+	err = os.Mkdir(path+".tmp", 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	filter.Check(salt)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("compaction error not reported")
+	}
+	if filter.Close() == nil {
+		t.Fatal("expected compaction error on close")
+	}
+
+	// the salt is still written to the old file
+	os.Remove(path + ".tmp")
+	filter, err = shadowreplay.OpenFileFilter(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Close()
+	if filter.Check(salt) {
+		t.Fatal("salt checked after failed compaction accepted")
+	}
+}
+
+func TestFileFilterService(t *testing.T) {
+	t.Parallel()
+	var psk [16]byte
+	rand.Read(psk[:])
+	for _, test := range []struct {
+		name       string
+		newClient  func() (shadowsocks.Method, error)
+		newService func(filter *shadowreplay.FileFilter) (shadowsocks.Service, error)
+		err        error
+	}{
+		{
+			name: "aead",
+			newClient: func() (shadowsocks.Method, error) {
+				return shadowaead.New("aes-128-gcm", psk[:], "")
+			},
+			newService: func(filter *shadowreplay.FileFilter) (shadowsocks.Service, error) {
+				service, err := shadowaead.NewService("aes-128-gcm", psk[:], "", 500, &fileFilterHandler{})
+				if err != nil {
+					return nil, err
+				}
+				service.SetReplayFilter(filter)
+				return service, nil
+			},
+			err: shadowaead.ErrSaltNotUnique,
+		},
+		{
+			name: "2022",
+			newClient: func() (shadowsocks.Method, error) {
+				return shadowaead_2022.New("2022-blake3-aes-128-gcm", [][]byte{psk[:]})
+			},
+			newService: func(filter *shadowreplay.FileFilter) (shadowsocks.Service, error) {
+				return shadowaead_2022.NewService("2022-blake3-aes-128-gcm", psk[:], 500, &fileFilterHandler{}, shadowaead_2022.ServiceWithReplayFilter(filter))
+			},
+			err: shadowaead_2022.ErrSaltNotUnique,
+		},
+	} {
+		client, err := test.newClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		handshake := &writeRecorder{}
+		_, err = client.DialEarlyConn(handshake, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "replay")
+		// the handshake is replayed to a service restarted with the same file
+		for i := 0; i < 2; i++ {
+			filter, err := shadowreplay.OpenFileFilter(path, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			service, err := test.newService(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverConn, clientConn := net.Pipe()
+			go func() {
+				clientConn.Write(handshake.buffer.Bytes())
+				clientConn.Close()
+			}()
+			err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+			serverConn.Close()
+			if i == 0 && err != nil {
+				t.Fatal(test.name, ": ", err)
+			} else if i == 1 && !errors.Is(err, test.err) {
+				t.Fatal(test.name, ": expected replay rejected after restart, got ", err)
+			}
+			err = filter.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+type writeRecorder struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (c *writeRecorder) Write(p []byte) (int, error) {
+	return c.buffer.Write(p)
+}
+
+type fileFilterHandler struct{}
+
+func (h *fileFilterHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *fileFilterHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *fileFilterHandler) NewError(ctx context.Context, err error) {
+}
@@ -0,0 +1,65 @@
+package shadowreplay
+
+import (
+	"hash/maphash"
+	"runtime"
+	"time"
+
+	"github.com/sagernet/sing/common/replay"
+)
+
+var _ replay.Filter = (*ShardedFilter)(nil)
+
+// ShardedFilter spreads salts over independently locked filters, so concurrent checks
+// rarely contend on the same lock. One instance can be shared by multiple services
+// to reject a salt replayed to another listener.
+type ShardedFilter struct {
+	seed   maphash.Seed
+	mask   uint64
+	shards []replay.Filter
+}
+
+// NewShardedFilter creates a filter with shards rounded up to a power of two, each created by newFilter.
+// If shards is not positive, four shards per CPU are used.
+func NewShardedFilter(shards int, newFilter func() replay.Filter) *ShardedFilter {
+	size := shardCount(shards)
+	f := &ShardedFilter{
+		seed:   maphash.MakeSeed(),
+		mask:   uint64(size - 1),
+		shards: make([]replay.Filter, size),
+	}
+	for i := range f.shards {
+		f.shards[i] = newFilter()
+	}
+	return f
+}
+
+// NewShardedBloomRing creates a sharded filter of bloom rings sharing capacity entries per generation.
+func NewShardedBloomRing(shards int, capacity int, lifetime time.Duration) *ShardedFilter {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	shards = shardCount(shards)
+	shardCapacity := (capacity + shards - 1) / shards
+	return NewShardedFilter(shards, func() replay.Filter {
+		return NewBloomRing(shardCapacity, lifetime)
+	})
+}
+
+func shardCount(shards int) int {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0) * 4
+	}
+	size := 1
+	for size < shards {
+		size <<= 1
+	}
+	return size
+}
+
+func (f *ShardedFilter) Check(sum []byte) bool {
+	var hash maphash.Hash
+	hash.SetSeed(f.seed)
+	hash.Write(sum)
+	return f.shards[hash.Sum64()&f.mask].Check(sum)
+}
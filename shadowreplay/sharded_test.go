@@ -0,0 +1,34 @@
+package shadowreplay_test
+
+import (
+	"crypto/rand"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/shadowreplay"
+)
+
+func TestShardedFilter(t *testing.T) {
+	t.Parallel()
+	filter := shadowreplay.NewShardedBloomRing(0, 10000, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			salt := make([]byte, 32)
+			for j := 0; j < 500; j++ {
+				rand.Read(salt)
+				if !filter.Check(salt) {
+					t.Error("fresh salt rejected")
+					return
+				}
+				if filter.Check(salt) {
+					t.Error("replayed salt accepted")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
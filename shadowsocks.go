@@ -1,6 +1,7 @@
 package shadowsocks
 
 import (
+	"context"
 	"crypto/md5"
 	"net"
 
@@ -14,6 +15,8 @@ import (
 var (
 	ErrBadKey          = E.New("bad key")
 	ErrMissingPassword = E.New("missing password")
+	// ErrListLengthMismatch is returned when updating users with lists of different lengths.
+	ErrListLengthMismatch = E.New("list length mismatch")
 )
 
 type Method interface {
@@ -31,6 +34,14 @@ type Service interface {
 	E.Handler
 }
 
+// ShutdownService is implemented by services supporting graceful shutdown.
+type ShutdownService interface {
+	Service
+	// Shutdown stops accepting new connections and packets, expires UDP sessions and waits for
+	// TCP connections until ctx is done. It returns the number of sessions closed by force.
+	Shutdown(ctx context.Context) (int, error)
+}
+
 type Handler interface {
 	N.TCPConnectionHandler
 	N.UDPConnectionHandler
@@ -41,9 +52,16 @@ type ServerConnError struct {
 	net.Conn
 	Source M.Socksaddr
 	Cause  error
+	// Handshake is set if the error happened before the handshake completed.
+	Handshake bool
+	// Handled is set if a FailurePolicy took over the connection, Close will not reset it.
+	Handled bool
 }
 
 func (e *ServerConnError) Close() error {
+	if e.Handled {
+		return e.Conn.Close()
+	}
 	if conn, ok := common.Cast[*net.TCPConn](e.Conn); ok {
 		conn.SetLinger(0)
 	}
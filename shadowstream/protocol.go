@@ -41,6 +41,10 @@ type Method struct {
 }
 
 func New(method string, key []byte, password string) (shadowsocks.Method, error) {
+	return newMethod(method, key, password)
+}
+
+func newMethod(method string, key []byte, password string) (*Method, error) {
 	m := &Method{
 		name: method,
 	}
@@ -269,6 +273,9 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 		return M.Socksaddr{}, err
 	}
 	buffer.Truncate(n)
+	if buffer.Len() < c.saltLength {
+		return M.Socksaddr{}, io.ErrShortBuffer
+	}
 	stream, err := c.decryptConstructor(c.key, buffer.To(c.saltLength))
 	if err != nil {
 		return M.Socksaddr{}, err
@@ -283,6 +290,9 @@ func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 	if err != nil {
 		return
 	}
+	if n < c.saltLength {
+		return 0, nil, io.ErrShortBuffer
+	}
 	stream, err := c.decryptConstructor(c.key, p[:c.saltLength])
 	if err != nil {
 		return
@@ -0,0 +1,286 @@
+package shadowstream
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/udpnat"
+)
+
+var _ shadowsocks.ShutdownService = (*Service)(nil)
+
+type Service struct {
+	method   *Method
+	password string
+	handler  shadowsocks.Handler
+	udpNat   *udpnat.Service[netip.AddrPort]
+	registry *shadowsocks.Registry
+	events   shadowsocks.EventHandler
+	shutdown shadowsocks.ShutdownGroup
+	mux      bool
+}
+
+func NewService(method string, key []byte, password string, udpTimeout int64, handler shadowsocks.Handler) (*Service, error) {
+	m, err := newMethod(method, key, password)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		method:   m,
+		password: password,
+		handler:  handler,
+		udpNat:   udpnat.New[netip.AddrPort](udpTimeout, handler),
+	}
+	return s, nil
+}
+
+func (s *Service) Name() string {
+	return s.method.name
+}
+
+func (s *Service) Password() string {
+	return s.password
+}
+
+// SetRegistry enables tracking of live connections and UDP sessions, nil disables it.
+func (s *Service) SetRegistry(registry *shadowsocks.Registry) {
+	s.registry = registry
+}
+
+// SetEventHandler sets the handler of structured events, nil disables them.
+func (s *Service) SetEventHandler(handler shadowsocks.EventHandler) {
+	s.events = handler
+}
+
+// SetMux enables serving mux sessions, each stream is tracked as a connection.
+func (s *Service) SetMux(enabled bool) {
+	s.mux = enabled
+}
+
+func (s *Service) handleConnection(ctx context.Context, conn net.Conn, metadata M.Metadata, user any) error {
+	if s.mux {
+		return shadowsocks.HandleMuxConnection(ctx, s.handler, conn, metadata, shadowsocks.MuxOptions{Registry: s.registry, User: user, Shutdown: &s.shutdown})
+	}
+	return shadowsocks.HandleConnection(ctx, s.handler, conn, metadata)
+}
+
+func (s *Service) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	var err error
+	if s.shutdown.AcquireConn(conn) {
+		err = shadowsocks.ServeConnection(ctx, conn, metadata, nil, s.newConnection)
+		s.shutdown.ReleaseConn(conn)
+	} else {
+		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: shadowsocks.ErrServiceClosed, Handshake: true}
+	}
+	if s.events != nil && shadowsocks.IsHandshakeError(err) {
+		s.reportError(ctx, N.NetworkTCP, metadata, err)
+	}
+	return err
+}
+
+func (s *Service) reportError(ctx context.Context, network string, metadata M.Metadata, err error) {
+	shadowsocks.ReportRejected(ctx, s.events, shadowsocks.Event{Network: network, Method: s.method.name, Source: metadata.Source, Cause: err})
+}
+
+func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_salt := buf.Make(s.method.saltLength)
+	defer common.KeepAlive(_salt)
+	salt := common.Dup(_salt)
+	_, err := io.ReadFull(conn, salt)
+	if err != nil {
+		return E.Cause(err, "read salt")
+	}
+	readStream, err := s.method.decryptConstructor(s.method.key, salt)
+	if err != nil {
+		return err
+	}
+	protocolConn := &serverConn{
+		Service:    s,
+		Conn:       conn,
+		readStream: readStream,
+	}
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(protocolConn)
+	if err != nil {
+		return E.Cause(err, "read destination")
+	}
+
+	metadata.Protocol = "shadowsocks"
+	metadata.Destination = destination
+	latency := shadowsocks.HandshakeSuccess(conn)
+	if s.events != nil {
+		s.events.HandleEvent(ctx, shadowsocks.Event{Type: shadowsocks.EventHandshakeAccepted, Network: N.NetworkTCP, Method: s.method.name, Source: metadata.Source, Destination: metadata.Destination, User: nil, Latency: latency})
+	}
+	if s.registry != nil {
+		registryConn := s.registry.TrackConn(protocolConn, metadata, nil)
+		defer s.registry.Untrack(registryConn)
+		return s.handleConnection(ctx, registryConn, metadata, nil)
+	}
+	return s.handleConnection(ctx, protocolConn, metadata, nil)
+}
+
+func (s *Service) NewError(ctx context.Context, err error) {
+	s.handler.NewError(ctx, err)
+}
+
+type serverConn struct {
+	*Service
+	net.Conn
+	access      sync.Mutex
+	readStream  cipher.Stream
+	writeStream cipher.Stream
+}
+
+func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
+	saltLength := c.method.saltLength
+	_buffer := buf.StackNewSize(saltLength + len(payload))
+	defer common.KeepAlive(_buffer)
+	buffer := common.Dup(_buffer)
+	defer buffer.Release()
+
+	salt := buffer.Extend(saltLength)
+	common.Must1(io.ReadFull(rand.Reader, salt))
+	writeStream, err := c.method.encryptConstructor(c.method.key, salt)
+	if err != nil {
+		return
+	}
+	if len(payload) > 0 {
+		writeStream.XORKeyStream(buffer.Extend(len(payload)), payload)
+	}
+	_, err = c.Conn.Write(buffer.Bytes())
+	if err != nil {
+		return
+	}
+	c.writeStream = writeStream
+	n = len(payload)
+	return
+}
+
+func (c *serverConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 {
+		c.readStream.XORKeyStream(p[:n], p[:n])
+	}
+	return
+}
+
+func (c *serverConn) Write(p []byte) (n int, err error) {
+	if c.writeStream != nil {
+		c.writeStream.XORKeyStream(p, p)
+		return c.Conn.Write(p)
+	}
+	c.access.Lock()
+	if c.writeStream != nil {
+		c.access.Unlock()
+		c.writeStream.XORKeyStream(p, p)
+		return c.Conn.Write(p)
+	}
+	defer c.access.Unlock()
+	return c.writeResponse(p)
+}
+
+func (c *serverConn) Upstream() any {
+	return c.Conn
+}
+
+// Shutdown stops accepting new connections and packets, see shadowsocks.ShutdownGroup.
+func (s *Service) Shutdown(ctx context.Context) (int, error) {
+	return s.shutdown.Shutdown(ctx)
+}
+
+func (s *Service) WriteIsThreadUnsafe() {
+}
+
+func (s *Service) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	err := s.newPacket(ctx, conn, buffer, metadata)
+	if err != nil {
+		if s.events != nil {
+			s.reportError(ctx, N.NetworkUDP, metadata, err)
+		}
+		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
+	}
+	return err
+}
+
+func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	if !s.shutdown.AcquirePacket() {
+		return shadowsocks.ErrServiceClosed
+	}
+	defer s.shutdown.ReleasePacket()
+	saltLength := s.method.saltLength
+	if buffer.Len() < saltLength {
+		return io.ErrShortBuffer
+	}
+	stream, err := s.method.decryptConstructor(s.method.key, buffer.To(saltLength))
+	if err != nil {
+		return err
+	}
+	stream.XORKeyStream(buffer.From(saltLength), buffer.From(saltLength))
+	buffer.Advance(saltLength)
+
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
+	if err != nil {
+		return err
+	}
+
+	metadata.Protocol = "shadowsocks"
+	metadata.Destination = destination
+	source := metadata.Source.AddrPort()
+	packetLen := buffer.Len()
+	s.udpNat.NewPacket(ctx, source, buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
+		var writer N.PacketWriter = &serverPacketWriter{s, conn, natConn}
+		if s.registry != nil {
+			writer = s.registry.TrackPacketWriter(s, source, 0, natConn, writer, metadata, nil)
+		}
+		if s.events != nil {
+			writer = shadowsocks.SessionEventWriter(ctx, s.events, shadowsocks.Event{Method: s.method.name, Source: metadata.Source, Destination: metadata.Destination, User: nil}, writer)
+		}
+		return s.shutdown.TrackPacketWriter(natConn, writer)
+	})
+	if s.registry != nil {
+		s.registry.TrackPacket(s, source, packetLen)
+	}
+	return nil
+}
+
+type serverPacketWriter struct {
+	*Service
+	source N.PacketConn
+	nat    N.PacketConn
+}
+
+func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	saltLength := w.method.saltLength
+	header := buf.With(buffer.ExtendHeader(saltLength + M.SocksaddrSerializer.AddrPortLen(destination)))
+	common.Must1(header.ReadFullFrom(rand.Reader, saltLength))
+	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	stream, err := w.method.encryptConstructor(w.method.key, buffer.To(saltLength))
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	stream.XORKeyStream(buffer.From(saltLength), buffer.From(saltLength))
+	return w.source.WritePacket(buffer, M.SocksaddrFromNet(w.nat.LocalAddr()))
+}
+
+func (w *serverPacketWriter) FrontHeadroom() int {
+	return w.method.saltLength + M.MaxSocksaddrLength
+}
+
+func (w *serverPacketWriter) Upstream() any {
+	return w.source
+}
@@ -0,0 +1,202 @@
+package shadowstream_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/shadowstream"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestService(t *testing.T) {
+	t.Parallel()
+	for _, method := range shadowstream.List {
+		method := method
+		t.Run(method, func(t *testing.T) {
+			t.Parallel()
+			testService(t, method)
+		})
+	}
+}
+
+func testService(t *testing.T, method string) {
+	password := "password"
+
+	var wg sync.WaitGroup
+
+	service, err := shadowstream.NewService(method, nil, password, 500, &testHandler{t, &wg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := shadowstream.New(method, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go func() {
+		err := service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		if err != nil {
+			serverConn.Close()
+			t.Error(E.Cause(err, "server"))
+			return
+		}
+	}()
+	conn, err := client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	_, err = conn.Read(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "pong" {
+		t.Error("bad response")
+	}
+	wg.Wait()
+}
+
+func TestServicePacket(t *testing.T) {
+	t.Parallel()
+	for _, method := range []string{"aes-128-cfb", "chacha20-ietf"} {
+		method := method
+		t.Run(method, func(t *testing.T) {
+			t.Parallel()
+			testServicePacket(t, method)
+		})
+	}
+}
+
+func testServicePacket(t *testing.T, method string) {
+	password := "password"
+
+	var wg sync.WaitGroup
+	service, err := shadowstream.NewService(method, nil, password, 500, &testHandler{t, &wg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := shadowstream.New(method, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPipe := &clientPacketPipe{requests: make(chan []byte, 1), responses: make(chan []byte, 1)}
+	serverPipe := &serverPacketPipe{responses: clientPipe.responses}
+	packetConn := client.DialPacketConn(clientPipe)
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	wg.Add(1)
+	_, err = packetConn.WriteTo([]byte("ping"), destination.UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.NewPacket(context.Background(), serverPipe, buf.As(<-clientPipe.requests), M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 1024)
+	n, addr, err := packetConn.ReadFrom(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response[:n]) != "ping" || M.SocksaddrFromNet(addr) != destination {
+		t.Fatal("bad response from ", addr, ": ", response[:n])
+	}
+	wg.Wait()
+
+	// packets shorter than the salt are rejected in both directions
+	err = service.NewPacket(context.Background(), serverPipe, buf.As([]byte("ping")), M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+	if !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatal("expected short packet rejected, got ", err)
+	}
+	clientPipe.responses <- []byte("ping")
+	_, _, err = packetConn.ReadFrom(response)
+	if !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatal("expected short response rejected, got ", err)
+	}
+	clientPipe.responses <- []byte("ping")
+	buffer := buf.NewPacket()
+	defer buffer.Release()
+	_, err = packetConn.ReadPacket(buffer)
+	if !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatal("expected short response rejected, got ", err)
+	}
+}
+
+type clientPacketPipe struct {
+	net.Conn
+	requests  chan []byte
+	responses chan []byte
+}
+
+func (c *clientPacketPipe) Write(p []byte) (int, error) {
+	c.requests <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *clientPacketPipe) Read(p []byte) (int, error) {
+	return copy(p, <-c.responses), nil
+}
+
+type serverPacketPipe struct {
+	N.PacketConn
+	responses chan []byte
+}
+
+func (c *serverPacketPipe) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	c.responses <- append([]byte(nil), buffer.Bytes()...)
+	return nil
+}
+
+type testHandler struct {
+	t  *testing.T
+	wg *sync.WaitGroup
+}
+
+func (h *testHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	defer h.wg.Done()
+	if metadata.Destination.String() != "test.com:443" {
+		h.t.Error("bad destination")
+	}
+	request := make([]byte, 4)
+	_, err := conn.Read(request)
+	if err != nil {
+		return err
+	}
+	if string(request) != "ping" {
+		h.t.Error("bad request")
+	}
+	_, err = conn.Write([]byte("pong"))
+	return err
+}
+
+func (h *testHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	defer h.wg.Done()
+	buffer := buf.NewPacket()
+	destination, err := conn.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	return conn.WritePacket(buffer, destination)
+}
+
+func (h *testHandler) NewError(ctx context.Context, err error) {
+	h.t.Error(ctx, err)
+}
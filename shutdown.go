@@ -0,0 +1,200 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var ErrServiceClosed = E.New("service closed")
+
+// ShutdownGroup tracks the connections and UDP sessions of a service for Shutdown.
+// The zero value is ready to use.
+type ShutdownGroup struct {
+	access       sync.Mutex
+	closed       bool
+	conns        map[net.Conn]struct{}
+	connGroup    sync.WaitGroup
+	sessions     map[*shutdownPacketWriter]struct{}
+	sessionsDone bool
+	lateSessions []io.Closer
+	packets      int
+	packetsDone  chan struct{}
+	closing      chan struct{}
+}
+
+// Closing returns a channel closed when Shutdown is called.
+func (g *ShutdownGroup) Closing() <-chan struct{} {
+	g.access.Lock()
+	defer g.access.Unlock()
+	if g.closing == nil {
+		g.closing = make(chan struct{})
+		if g.closed {
+			close(g.closing)
+		}
+	}
+	return g.closing
+}
+
+// AcquireConn registers a connection until ReleaseConn is called,
+// it returns false if the service is shut down.
+func (g *ShutdownGroup) AcquireConn(conn net.Conn) bool {
+	g.access.Lock()
+	defer g.access.Unlock()
+	if g.closed {
+		return false
+	}
+	if g.conns == nil {
+		g.conns = make(map[net.Conn]struct{})
+	}
+	g.conns[conn] = struct{}{}
+	g.connGroup.Add(1)
+	return true
+}
+
+func (g *ShutdownGroup) ReleaseConn(conn net.Conn) {
+	g.access.Lock()
+	delete(g.conns, conn)
+	g.access.Unlock()
+	g.connGroup.Done()
+}
+
+// AcquirePacket must be called before handling a packet, it returns false if the service
+// is shut down. Otherwise ReleasePacket must be called once the packet is passed to the NAT.
+func (g *ShutdownGroup) AcquirePacket() bool {
+	g.access.Lock()
+	defer g.access.Unlock()
+	if g.closed {
+		return false
+	}
+	g.packets++
+	return true
+}
+
+// ReleasePacket also closes the UDP sessions created by packets that were still in flight
+// when Shutdown gave up waiting for them, once no packet is passed to the NAT anymore.
+func (g *ShutdownGroup) ReleasePacket() {
+	g.access.Lock()
+	g.packets--
+	var lateSessions []io.Closer
+	if g.packets == 0 {
+		if g.packetsDone != nil {
+			close(g.packetsDone)
+			g.packetsDone = nil
+		}
+		lateSessions = g.lateSessions
+		g.lateSessions = nil
+	}
+	g.access.Unlock()
+	for _, natConn := range lateSessions {
+		natConn.Close()
+	}
+}
+
+// TrackPacketWriter registers the UDP session until the writer is closed,
+// natConn is closed to expire the session on Shutdown.
+func (g *ShutdownGroup) TrackPacketWriter(natConn io.Closer, writer N.PacketWriter) N.PacketWriter {
+	session := &shutdownPacketWriter{writer, g, natConn}
+	g.access.Lock()
+	if g.sessionsDone {
+		// the session can't be closed from the NAT callback, ReleasePacket closes it
+		g.lateSessions = append(g.lateSessions, natConn)
+		g.access.Unlock()
+		return writer
+	}
+	if g.sessions == nil {
+		g.sessions = make(map[*shutdownPacketWriter]struct{})
+	}
+	g.sessions[session] = struct{}{}
+	g.access.Unlock()
+	return session
+}
+
+// Shutdown stops accepting new connections and packets, expires all UDP sessions and waits
+// for TCP connections to finish until ctx is done, then closes the remaining ones.
+// It returns the number of UDP sessions and connections closed by force, and ctx.Err() if
+// the packets in flight or the connections did not finish in time.
+func (g *ShutdownGroup) Shutdown(ctx context.Context) (int, error) {
+	g.access.Lock()
+	if !g.closed && g.closing != nil {
+		close(g.closing)
+	}
+	g.closed = true
+	var packetsDone chan struct{}
+	if g.packets > 0 {
+		if g.packetsDone == nil {
+			g.packetsDone = make(chan struct{})
+		}
+		packetsDone = g.packetsDone
+	}
+	g.access.Unlock()
+
+	// packets in flight may still create UDP sessions, a packet blocked on a busy
+	// session is not waited for longer than ctx
+	var err error
+	if packetsDone != nil {
+		select {
+		case <-packetsDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	g.access.Lock()
+	g.sessionsDone = true
+	sessions := make([]*shutdownPacketWriter, 0, len(g.sessions))
+	for session := range g.sessions {
+		sessions = append(sessions, session)
+	}
+	g.access.Unlock()
+	for _, session := range sessions {
+		session.natConn.Close()
+	}
+	forceClosed := len(sessions)
+
+	done := make(chan struct{})
+	go func() {
+		g.connGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return forceClosed, err
+	case <-ctx.Done():
+	}
+
+	g.access.Lock()
+	conns := make([]net.Conn, 0, len(g.conns))
+	for conn := range g.conns {
+		conns = append(conns, conn)
+	}
+	g.access.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return forceClosed + len(conns), ctx.Err()
+}
+
+type shutdownPacketWriter struct {
+	N.PacketWriter
+	group   *ShutdownGroup
+	natConn io.Closer
+}
+
+func (w *shutdownPacketWriter) Close() error {
+	w.group.access.Lock()
+	delete(w.group.sessions, w)
+	w.group.access.Unlock()
+	if closer, isCloser := w.PacketWriter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (w *shutdownPacketWriter) Upstream() any {
+	return w.PacketWriter
+}
@@ -0,0 +1,148 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+	handler := &shutdownHandler{tcpStarted: make(chan struct{}), udpStarted: make(chan struct{})}
+	service := shadowsocks.NewNoneService(500, handler)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	conn := shadowsocks.NewNone().DialEarlyConn(clientConn, M.ParseSocksaddr("1.1.1.1:80"))
+	go conn.Write([]byte("hello"))
+	<-handler.tcpStarted
+
+	buffer := buf.New()
+	M.SocksaddrSerializer.WriteAddrPort(buffer, M.ParseSocksaddr("1.1.1.1:53"))
+	buffer.WriteString("ping")
+	err := service.NewPacket(context.Background(), nil, buffer, M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handler.udpStarted
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	forceClosed, err := service.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got ", err)
+	}
+	if forceClosed != 2 {
+		t.Fatal("expected 2 force closed sessions, got ", forceClosed)
+	}
+
+	serverConn, clientConn = net.Pipe()
+	defer clientConn.Close()
+	err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	if !errors.Is(err, shadowsocks.ErrServiceClosed) {
+		t.Fatal("expected service closed, got ", err)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	t.Parallel()
+	handler := &shutdownHandler{tcpStarted: make(chan struct{}), udpStarted: make(chan struct{})}
+	service := shadowsocks.NewNoneService(500, handler)
+
+	serverConn, clientConn := net.Pipe()
+	go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	conn := shadowsocks.NewNone().DialEarlyConn(clientConn, M.ParseSocksaddr("1.1.1.1:80"))
+	go conn.Write([]byte("hello"))
+	<-handler.tcpStarted
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		clientConn.Close()
+	}()
+	forceClosed, err := service.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forceClosed != 0 {
+		t.Fatal("expected no force closed sessions, got ", forceClosed)
+	}
+}
+
+func TestShutdownBlockedPacket(t *testing.T) {
+	t.Parallel()
+	handler := &shutdownHandler{tcpStarted: make(chan struct{}), udpStarted: make(chan struct{}), udpRelease: make(chan struct{})}
+	service := shadowsocks.NewNoneService(500, handler)
+	defer close(handler.udpRelease)
+
+	sent := make(chan struct{})
+	go func() {
+		// the session buffers 64 packets, the last one blocks until the handler reads
+		for i := 0; i < 66; i++ {
+			buffer := buf.New()
+			M.SocksaddrSerializer.WriteAddrPort(buffer, M.ParseSocksaddr("1.1.1.1:53"))
+			buffer.WriteString("ping")
+			service.NewPacket(context.Background(), nil, buffer, M.Metadata{Source: M.ParseSocksaddr("10.0.0.1:1000")})
+		}
+		close(sent)
+	}()
+	<-handler.udpStarted
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	forceClosed, err := service.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got ", err)
+	}
+	if forceClosed != 1 {
+		t.Fatal("expected 1 force closed session, got ", forceClosed)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("shutdown blocked by the packet")
+	}
+	select {
+	case <-sent:
+		t.Fatal("expected blocked packet")
+	default:
+	}
+}
+
+type shutdownHandler struct {
+	tcpStarted chan struct{}
+	udpStarted chan struct{}
+	udpRelease chan struct{}
+}
+
+func (h *shutdownHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	close(h.tcpStarted)
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *shutdownHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	close(h.udpStarted)
+	if h.udpRelease != nil {
+		<-h.udpRelease
+	}
+	for {
+		buffer := buf.New()
+		_, err := conn.ReadPacket(buffer)
+		buffer.Release()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (h *shutdownHandler) NewError(ctx context.Context, err error) {
+}
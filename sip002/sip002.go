@@ -0,0 +1,130 @@
+package sip002
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowimpl"
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const Scheme = "ss"
+
+var (
+	ErrBadScheme   = E.New("sip002: bad scheme")
+	ErrBadUserInfo = E.New("sip002: bad user info")
+	ErrBadServer   = E.New("sip002: bad server address")
+)
+
+// Config is a server described by a SIP002 URI.
+// https://shadowsocks.org/doc/sip002.html
+type Config struct {
+	Method        string
+	Password      string
+	Server        M.Socksaddr
+	Plugin        string
+	PluginOptions string
+	Tag           string
+}
+
+func Parse(link string) (*Config, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, E.Cause(err, "sip002: parse url")
+	}
+	if u.Scheme != Scheme {
+		return nil, ErrBadScheme
+	}
+	if u.User == nil {
+		return nil, ErrBadUserInfo
+	}
+	var config Config
+	if password, loaded := u.User.Password(); loaded {
+		config.Method = u.User.Username()
+		config.Password = password
+	} else {
+		userInfo, err := decodeBase64(u.User.Username())
+		if err != nil {
+			return nil, E.Cause(err, "sip002: decode user info")
+		}
+		method, password, loaded := strings.Cut(userInfo, ":")
+		if !loaded {
+			return nil, ErrBadUserInfo
+		}
+		config.Method = method
+		config.Password = password
+	}
+	if config.Method == "" {
+		return nil, ErrBadUserInfo
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil || u.Hostname() == "" || port == 0 {
+		return nil, ErrBadServer
+	}
+	config.Server = M.ParseSocksaddrHostPort(u.Hostname(), uint16(port))
+	plugin, err := queryValue(u.RawQuery, "plugin")
+	if err != nil {
+		return nil, E.Cause(err, "sip002: decode plugin")
+	}
+	if plugin != "" {
+		config.Plugin, config.PluginOptions, _ = strings.Cut(plugin, ";")
+	}
+	config.Tag = u.Fragment
+	return &config, nil
+}
+
+// queryValue returns the first value of key in query. Unlike url.Query, '+' is kept
+// as is, as plugin options are percent-encoded.
+func queryValue(query string, key string) (string, error) {
+	for _, pair := range strings.Split(query, "&") {
+		name, value, _ := strings.Cut(pair, "=")
+		if name == key {
+			return url.PathUnescape(value)
+		}
+	}
+	return "", nil
+}
+
+func decodeBase64(content string) (string, error) {
+	content = strings.TrimRight(content, "=")
+	if strings.ContainsAny(content, "+/") {
+		decoded, err := base64.RawStdEncoding.DecodeString(content)
+		return string(decoded), err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(content)
+	return string(decoded), err
+}
+
+// String returns the SIP002 URI of the config.
+// Shadowsocks 2022 methods use plain percent-encoded user info, other methods use base64url.
+func (c *Config) String() string {
+	u := url.URL{
+		Scheme:   Scheme,
+		Host:     c.Server.String(),
+		Fragment: c.Tag,
+	}
+	if common.Contains(shadowaead_2022.List, c.Method) {
+		u.User = url.UserPassword(c.Method, c.Password)
+	} else {
+		u.User = url.User(base64.RawURLEncoding.EncodeToString([]byte(c.Method + ":" + c.Password)))
+	}
+	if c.Plugin != "" {
+		plugin := c.Plugin
+		if c.PluginOptions != "" {
+			plugin += ";" + c.PluginOptions
+		}
+		u.Path = "/"
+		u.RawQuery = "plugin=" + strings.ReplaceAll(url.QueryEscape(plugin), "+", "%20")
+	}
+	return u.String()
+}
+
+func (c *Config) NewMethod() (shadowsocks.Method, error) {
+	return shadowimpl.FetchMethod(c.Method, c.Password)
+}
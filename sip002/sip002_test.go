@@ -0,0 +1,111 @@
+package sip002_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/sip002"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		link   string
+		config sip002.Config
+	}{
+		{
+			link: "ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+			config: sip002.Config{
+				Method:   "aes-128-gcm",
+				Password: "test",
+				Server:   M.ParseSocksaddr("192.168.100.1:8888"),
+				Tag:      "Example1",
+			},
+		},
+		{
+			link: "ss://cmM0LW1kNTpwYXNzd2Q@192.168.100.1:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example2",
+			config: sip002.Config{
+				Method:        "rc4-md5",
+				Password:      "passwd",
+				Server:        M.ParseSocksaddr("192.168.100.1:8888"),
+				Plugin:        "obfs-local",
+				PluginOptions: "obfs=http",
+				Tag:           "Example2",
+			},
+		},
+		{
+			link: "ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888/?plugin=v2ray-plugin%3Bpath%3D%2Fa+b%20c",
+			config: sip002.Config{
+				Method:        "aes-128-gcm",
+				Password:      "test",
+				Server:        M.ParseSocksaddr("192.168.100.1:8888"),
+				Plugin:        "v2ray-plugin",
+				PluginOptions: "path=/a+b c",
+			},
+		},
+		{
+			link: "ss://2022-blake3-aes-256-gcm:YctPZ6U7xPPcU%2Bgp3u%2B0tx%2FtRizJN9K8y%2BuKlW2qjlI%3D@[::1]:8888#Example%203",
+			config: sip002.Config{
+				Method:   "2022-blake3-aes-256-gcm",
+				Password: "YctPZ6U7xPPcU+gp3u+0tx/tRizJN9K8y+uKlW2qjlI=",
+				Server:   M.ParseSocksaddr("[::1]:8888"),
+				Tag:      "Example 3",
+			},
+		},
+	} {
+		config, err := sip002.Parse(testCase.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *config != testCase.config {
+			t.Fatal("bad config: ", testCase.link)
+		}
+		roundTrip, err := sip002.Parse(config.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *roundTrip != *config {
+			t.Fatal("bad round trip: ", config.String())
+		}
+		_, err = config.NewMethod()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		link string
+		err  error
+	}{
+		{"http://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888", sip002.ErrBadScheme},
+		{"ss://YWVzLTEyOC1nY20@192.168.100.1:8888", sip002.ErrBadUserInfo},
+		{"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1", sip002.ErrBadServer},
+		{"ss://YWVzLTEyOC1nY206dGVzdA@:8888", sip002.ErrBadServer},
+	} {
+		_, err := sip002.Parse(testCase.link)
+		if !errors.Is(err, testCase.err) {
+			t.Fatal("expected ", testCase.err, " for ", testCase.link, ", got ", err)
+		}
+	}
+	for _, link := range []string{
+		"ss://not*base64@192.168.100.1:8888",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888/?plugin=obfs-local%3",
+	} {
+		_, err := sip002.Parse(link)
+		if err == nil {
+			t.Fatal("expected error for ", link)
+		}
+	}
+	config, err := sip002.Parse("ss://dW5rbm93bjp0ZXN0@192.168.100.1:8888")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.NewMethod()
+	if err == nil {
+		t.Fatal("expected unknown method rejected")
+	}
+}
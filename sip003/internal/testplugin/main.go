@@ -0,0 +1,43 @@
+// Command testplugin is a SIP003 plugin stand-in for tests, it forwards
+// SS_LOCAL connections to SS_REMOTE without any obfuscation.
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+func main() {
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	listen, forward := local, remote
+	if os.Getenv("SS_PLUGIN_OPTIONS") == "server" {
+		listen, forward = remote, local
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		os.Exit(1)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		go forwardConn(conn, forward)
+	}
+}
+
+func forwardConn(conn net.Conn, forward string) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", forward)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(conn, upstream)
+}
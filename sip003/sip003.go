@@ -0,0 +1,205 @@
+package sip003
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// StartupTimeout is how long dials keep retrying while the plugin has not started listening yet.
+const StartupTimeout = 5 * time.Second
+
+var ErrPluginExited = E.New("sip003: plugin exited")
+
+// Config describes a SIP003 plugin.
+// https://shadowsocks.org/doc/sip003.html
+type Config struct {
+	Plugin        string
+	PluginOptions string
+	Stdout        io.Writer
+	Stderr        io.Writer
+}
+
+type Plugin struct {
+	cmd     *exec.Cmd
+	local   M.Socksaddr
+	started time.Time
+	done    chan struct{}
+	err     error
+	close   sync.Once
+}
+
+func start(ctx context.Context, config Config, remote M.Socksaddr, local M.Socksaddr) (*Plugin, error) {
+	cmd := exec.CommandContext(ctx, config.Plugin)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+remote.AddrString(),
+		"SS_REMOTE_PORT="+strconv.Itoa(int(remote.Port)),
+		"SS_LOCAL_HOST="+local.AddrString(),
+		"SS_LOCAL_PORT="+strconv.Itoa(int(local.Port)),
+		"SS_PLUGIN_OPTIONS="+config.PluginOptions,
+	)
+	cmd.Stdout = config.Stdout
+	cmd.Stderr = config.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return nil, E.Cause(err, "sip003: start plugin ", config.Plugin)
+	}
+	p := &Plugin{
+		cmd:     cmd,
+		local:   local,
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	go p.wait()
+	return p, nil
+}
+
+func (p *Plugin) wait() {
+	err := p.cmd.Wait()
+	if err == nil {
+		err = ErrPluginExited
+	} else {
+		err = E.Cause(err, ErrPluginExited)
+	}
+	p.err = err
+	close(p.done)
+}
+
+// Done is closed when the plugin process exits.
+func (p *Plugin) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns the exit reason after Done is closed.
+func (p *Plugin) Err() error {
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+func (p *Plugin) Close() error {
+	p.close.Do(func() {
+		select {
+		case <-p.done:
+		default:
+			p.cmd.Process.Kill()
+		}
+	})
+	<-p.done
+	return nil
+}
+
+type Client struct {
+	*Plugin
+	dialer net.Dialer
+}
+
+// StartClient starts the plugin in client mode, forwarding local connections to server.
+// The local port is picked by listening on a free port and closing it before the plugin
+// binds it, another process may take the port in between, in which case the plugin fails
+// to listen and exits, or dials reach the other process.
+func StartClient(ctx context.Context, config Config, server M.Socksaddr) (*Client, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	plugin, err := start(ctx, config, server, M.ParseSocksaddrHostPort("127.0.0.1", port))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Plugin: plugin}, nil
+}
+
+// DialContext connects to the local plugin endpoint, the returned conn can be passed to Method.DialConn.
+func (c *Client) DialContext(ctx context.Context) (net.Conn, error) {
+	for {
+		select {
+		case <-c.done:
+			return nil, c.err
+		default:
+		}
+		conn, err := c.dialer.DialContext(ctx, "tcp", c.local.String())
+		if err == nil {
+			return conn, nil
+		}
+		if time.Since(c.started) > StartupTimeout {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, c.err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+var _ net.Listener = (*Server)(nil)
+
+type Server struct {
+	*Plugin
+	net.Listener
+}
+
+// StartServer starts the plugin in server mode listening on listen,
+// plugin connections are accepted from the returned listener and can be passed to Service.NewConnection.
+func StartServer(ctx context.Context, config Config, listen M.Socksaddr) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	plugin, err := start(ctx, config, listen, M.SocksaddrFromNet(listener.Addr()))
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		<-plugin.done
+		listener.Close()
+	}()
+	return &Server{plugin, listener}, nil
+}
+
+func (s *Server) Accept() (net.Conn, error) {
+	conn, err := s.Listener.Accept()
+	if err != nil {
+		select {
+		case <-s.done:
+			return nil, s.err
+		default:
+		}
+	}
+	return conn, err
+}
+
+// Close stops the plugin and the listener, which is already closed if the plugin exited.
+func (s *Server) Close() error {
+	err := s.Listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return E.Errors(err, s.Plugin.Close())
+}
+
+// freePort returns a port free at the time of the call, see StartClient.
+func freePort() (uint16, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return M.SocksaddrFromNet(listener.Addr()).Port, nil
+}
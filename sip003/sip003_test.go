@@ -0,0 +1,101 @@
+package sip003_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/sip003"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func buildTestPlugin(t *testing.T) string {
+	goBinary, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+	pluginPath := filepath.Join(t.TempDir(), "testplugin")
+	if runtime.GOOS == "windows" {
+		pluginPath += ".exe"
+	}
+	output, err := exec.Command(goBinary, "build", "-o", pluginPath, "./internal/testplugin").CombinedOutput()
+	if err != nil {
+		t.Fatal(string(output))
+	}
+	return pluginPath
+}
+
+func TestPlugin(t *testing.T) {
+	pluginPath := buildTestPlugin(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverAddr := M.SocksaddrFromNet(listener.Addr())
+	listener.Close()
+
+	server, err := sip003.StartServer(context.Background(), sip003.Config{Plugin: pluginPath, PluginOptions: "server"}, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	client, err := sip003.StartClient(context.Background(), sip003.Config{Plugin: pluginPath}, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := client.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "ping" {
+		t.Fatal("bad response")
+	}
+
+	client.Close()
+	<-client.Done()
+	if client.Err() == nil {
+		t.Fatal("missing exit error")
+	}
+
+	// the listener is closed when the plugin exits
+	server.Plugin.Close()
+	_, err = server.Accept()
+	if err == nil {
+		t.Fatal("expected accept error after the plugin exited")
+	}
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
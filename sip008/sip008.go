@@ -0,0 +1,209 @@
+package sip008
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowimpl"
+	"github.com/sagernet/sing-shadowsocks/shadowstream"
+	"github.com/sagernet/sing-shadowsocks/sip002"
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const Version = 1
+
+var (
+	ErrBadVersion      = E.New("sip008: unsupported version")
+	ErrMissingServers  = E.New("sip008: missing servers")
+	ErrMissingDocument = E.New("sip008: missing document")
+	ErrDuplicateID     = E.New("duplicate id")
+)
+
+// Document is a SIP008 online configuration document.
+// https://shadowsocks.org/doc/sip008.html
+type Document struct {
+	Version        int      `json:"version"`
+	Servers        []Server `json:"servers"`
+	BytesUsed      *uint64  `json:"bytes_used,omitempty"`
+	BytesRemaining *uint64  `json:"bytes_remaining,omitempty"`
+}
+
+type Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks,omitempty"`
+	Server     string `json:"server"`
+	ServerPort uint16 `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Plugin     string `json:"plugin,omitempty"`
+	PluginOpts string `json:"plugin_opts,omitempty"`
+}
+
+type ServerError struct {
+	Index int
+	ID    string
+	Cause error
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *ServerError) Error() string {
+	if e.ID != "" {
+		return F.ToString("sip008: server ", e.Index, " (", e.ID, "): ", e.Cause)
+	}
+	return F.ToString("sip008: server ", e.Index, ": ", e.Cause)
+}
+
+// Parse decodes a document and checks its version,
+// call Validate or Load to check the server entries.
+func Parse(content []byte) (*Document, error) {
+	return Decode(bytes.NewReader(content))
+}
+
+// Decode is Parse reading the document from reader.
+func Decode(reader io.Reader) (*Document, error) {
+	var document Document
+	err := json.NewDecoder(reader).Decode(&document)
+	if err != nil {
+		return nil, E.Cause(err, "sip008: decode document")
+	}
+	if document.Version != Version {
+		return nil, E.Extend(ErrBadVersion, document.Version)
+	}
+	return &document, nil
+}
+
+// Validate checks the document header and every server entry, returning the first error found.
+func (d *Document) Validate() error {
+	if d.Version != Version {
+		return E.Extend(ErrBadVersion, d.Version)
+	}
+	if len(d.Servers) == 0 {
+		return ErrMissingServers
+	}
+	ids := make(map[string]bool)
+	for i := range d.Servers {
+		err := d.Servers[i].Validate()
+		if err == nil && ids[d.Servers[i].ID] {
+			err = ErrDuplicateID
+		}
+		if err != nil {
+			return &ServerError{i, d.Servers[i].ID, err}
+		}
+		ids[d.Servers[i].ID] = true
+	}
+	return nil
+}
+
+func (s *Server) Validate() error {
+	if s.ID == "" {
+		return E.New("missing id")
+	} else if !isUUID(s.ID) {
+		return E.New("bad id: ", s.ID)
+	}
+	if s.Server == "" {
+		return E.New("missing server")
+	}
+	if s.ServerPort == 0 {
+		return E.New("missing server port")
+	}
+	if s.Method == "" {
+		return E.New("missing method")
+	}
+	if !IsSupported(s.Method) {
+		return E.New("unsupported method: ", s.Method)
+	}
+	if s.Password == "" && !isNone(s.Method) {
+		return shadowsocks.ErrMissingPassword
+	}
+	if s.PluginOpts != "" && s.Plugin == "" {
+		return E.New("plugin options without plugin")
+	}
+	return nil
+}
+
+func (s *Server) Config() *sip002.Config {
+	return &sip002.Config{
+		Method:        s.Method,
+		Password:      s.Password,
+		Server:        M.ParseSocksaddrHostPort(s.Server, s.ServerPort),
+		Plugin:        s.Plugin,
+		PluginOptions: s.PluginOpts,
+		Tag:           s.Remarks,
+	}
+}
+
+func IsSupported(method string) bool {
+	return isNone(method) ||
+		common.Contains(shadowstream.List, method) ||
+		common.Contains(shadowaead.List, method) ||
+		common.Contains(shadowaead_2022.List, method)
+}
+
+func isNone(method string) bool {
+	return method == "none" || method == "plain" || method == "dummy"
+}
+
+func isUUID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type Entry struct {
+	Server Server
+	Method shadowsocks.Method
+	Err    error
+}
+
+// Load validates every server entry and creates its method.
+// Invalid entries, including later entries with an id already used, are reported
+// through Entry.Err instead of failing the whole document.
+func Load(document *Document) ([]Entry, error) {
+	if document == nil {
+		return nil, ErrMissingDocument
+	}
+	if document.Version != Version {
+		return nil, E.Extend(ErrBadVersion, document.Version)
+	}
+	entries := make([]Entry, 0, len(document.Servers))
+	ids := make(map[string]bool)
+	for i, server := range document.Servers {
+		entry := Entry{Server: server}
+		err := server.Validate()
+		if err == nil && ids[server.ID] {
+			err = ErrDuplicateID
+		}
+		if err == nil {
+			ids[server.ID] = true
+			entry.Method, err = shadowimpl.FetchMethod(server.Method, server.Password)
+		}
+		if err != nil {
+			entry.Err = &ServerError{i, server.ID, err}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,117 @@
+package sip008_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/sip008"
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+	document, err := sip008.Parse([]byte(`{
+  "version": 1,
+  "servers": [
+    {
+      "id": "27b8a625-4f4b-4428-9f0f-8a2317db7c79",
+      "remarks": "Name of the server",
+      "server": "example.com",
+      "server_port": 8388,
+      "password": "example",
+      "method": "chacha20-ietf-poly1305",
+      "plugin": "xxx",
+      "plugin_opts": "xxxxx"
+    },
+    {
+      "id": "7842c068-c667-41f2-8f7d-04feece3cb67",
+      "remarks": "Name of the server",
+      "server": "example.com",
+      "server_port": 8388,
+      "password": "example",
+      "method": "bad-method"
+    }
+  ],
+  "bytes_used": 274877906944,
+  "bytes_remaining": 824633720832
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *document.BytesUsed != 274877906944 || *document.BytesRemaining != 824633720832 {
+		t.Fatal("bad traffic")
+	}
+	if document.Validate() == nil {
+		t.Fatal("expected validation error")
+	}
+	entries, err := sip008.Load(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Err != nil || entries[0].Method == nil {
+		t.Fatal(entries[0].Err)
+	}
+	if entries[1].Err == nil {
+		t.Fatal("expected entry error")
+	}
+	_, err = sip008.Parse([]byte(`{"version": 2, "servers": []}`))
+	if err == nil {
+		t.Fatal("expected version error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	server := sip008.Server{
+		ID:         "27b8a625-4f4b-4428-9f0f-8a2317db7c79",
+		Server:     "example.com",
+		ServerPort: 8388,
+		Password:   "example",
+		Method:     "chacha20-ietf-poly1305",
+	}
+	document := &sip008.Document{Version: sip008.Version, Servers: []sip008.Server{server}}
+	err := document.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, testCase := range map[string]struct {
+		update func(server *sip008.Server)
+		cause  error
+	}{
+		"non-uuid id":                {func(server *sip008.Server) { server.ID = "server-1" }, nil},
+		"plugin opts without plugin": {func(server *sip008.Server) { server.PluginOpts = "tls" }, nil},
+		"unsupported method":         {func(server *sip008.Server) { server.Method = "bad-method" }, nil},
+		"missing password":           {func(server *sip008.Server) { server.Password = "" }, shadowsocks.ErrMissingPassword},
+		"duplicate id":               {func(server *sip008.Server) { server.Remarks = "another server" }, sip008.ErrDuplicateID},
+	} {
+		badServer := server
+		testCase.update(&badServer)
+		document = &sip008.Document{Version: sip008.Version, Servers: []sip008.Server{server, badServer}}
+		err = document.Validate()
+		var serverErr *sip008.ServerError
+		if !errors.As(err, &serverErr) || serverErr.Index != 1 || testCase.cause != nil && !errors.Is(err, testCase.cause) {
+			t.Fatal(name, ": unexpected validation error: ", err)
+		}
+		entries, err := sip008.Load(document)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		if entries[0].Err != nil || entries[1].Err == nil || testCase.cause != nil && !errors.Is(entries[1].Err, testCase.cause) {
+			t.Fatal(name, ": unexpected entry errors: ", entries[0].Err, ", ", entries[1].Err)
+		}
+	}
+
+	document = &sip008.Document{Version: 2, Servers: []sip008.Server{server}}
+	if !errors.Is(document.Validate(), sip008.ErrBadVersion) {
+		t.Fatal("expected bad version")
+	}
+	_, err = sip008.Load(document)
+	if !errors.Is(err, sip008.ErrBadVersion) {
+		t.Fatal("expected bad version, got ", err)
+	}
+	_, err = sip008.Load(nil)
+	if !errors.Is(err, sip008.ErrMissingDocument) {
+		t.Fatal("expected missing document, got ", err)
+	}
+}
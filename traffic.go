@@ -0,0 +1,195 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type UserTraffic struct {
+	Upload         uint64
+	Download       uint64
+	TCPConnections int64
+	UDPSessions    int64
+}
+
+// TrafficTracker counts per-user traffic of multi-user services.
+// A tracker can be shared by multiple services.
+type TrafficTracker[U comparable] struct {
+	access sync.RWMutex
+	users  map[U]*userCounter
+}
+
+type userCounter struct {
+	upload         uint64
+	download       uint64
+	tcpConnections int64
+	udpSessions    int64
+}
+
+func NewTrafficTracker[U comparable]() *TrafficTracker[U] {
+	return &TrafficTracker[U]{
+		users: make(map[U]*userCounter),
+	}
+}
+
+func (t *TrafficTracker[U]) counter(user U) *userCounter {
+	t.access.RLock()
+	counter, loaded := t.users[user]
+	t.access.RUnlock()
+	if loaded {
+		return counter
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	counter, loaded = t.users[user]
+	if !loaded {
+		counter = &userCounter{}
+		t.users[user] = counter
+	}
+	return counter
+}
+
+// Snapshot returns the traffic of all users, byte counters are swapped to zero if reset is set.
+func (t *TrafficTracker[U]) Snapshot(reset bool) map[U]UserTraffic {
+	t.access.RLock()
+	defer t.access.RUnlock()
+	snapshot := make(map[U]UserTraffic, len(t.users))
+	for user, counter := range t.users {
+		var traffic UserTraffic
+		if reset {
+			traffic.Upload = atomic.SwapUint64(&counter.upload, 0)
+			traffic.Download = atomic.SwapUint64(&counter.download, 0)
+		} else {
+			traffic.Upload = atomic.LoadUint64(&counter.upload)
+			traffic.Download = atomic.LoadUint64(&counter.download)
+		}
+		traffic.TCPConnections = atomic.LoadInt64(&counter.tcpConnections)
+		traffic.UDPSessions = atomic.LoadInt64(&counter.udpSessions)
+		snapshot[user] = traffic
+	}
+	return snapshot
+}
+
+func (t *TrafficTracker[U]) Load(user U) UserTraffic {
+	counter := t.counter(user)
+	return UserTraffic{
+		Upload:         atomic.LoadUint64(&counter.upload),
+		Download:       atomic.LoadUint64(&counter.download),
+		TCPConnections: atomic.LoadInt64(&counter.tcpConnections),
+		UDPSessions:    atomic.LoadInt64(&counter.udpSessions),
+	}
+}
+
+// TrackConn counts the connection and the bytes read from and written to it until it is closed.
+func (t *TrafficTracker[U]) TrackConn(user U, conn net.Conn) net.Conn {
+	counter := t.counter(user)
+	atomic.AddInt64(&counter.tcpConnections, 1)
+	return &trafficConn{Conn: conn, counter: counter}
+}
+
+// TrackUpload counts bytes received from the user outside of tracked connections, e.g. UDP payloads.
+func (t *TrafficTracker[U]) TrackUpload(user U, n int) {
+	atomic.AddUint64(&t.counter(user).upload, uint64(n))
+}
+
+// TrackPacketWriter counts the UDP session and the bytes written back to the user until it is closed.
+func (t *TrafficTracker[U]) TrackPacketWriter(user U, writer N.PacketWriter) N.PacketWriter {
+	counter := t.counter(user)
+	atomic.AddInt64(&counter.udpSessions, 1)
+	return &trafficPacketWriter{PacketWriter: writer, counter: counter}
+}
+
+type trafficConn struct {
+	net.Conn
+	counter *userCounter
+	closed  uint32
+}
+
+func (c *trafficConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddUint64(&c.counter.upload, uint64(n))
+	return
+}
+
+func (c *trafficConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddUint64(&c.counter.download, uint64(n))
+	return
+}
+
+// WriteTo keeps the copy path of the tracked connection, counting while copying.
+func (c *trafficConn) WriteTo(w io.Writer) (n int64, err error) {
+	return bufio.Copy(&countWriter{w, &c.counter.upload}, c.Conn)
+}
+
+// ReadFrom keeps the copy path of the tracked connection, counting while copying.
+func (c *trafficConn) ReadFrom(r io.Reader) (n int64, err error) {
+	return bufio.Copy(c.Conn, &countReader{r, &c.counter.download})
+}
+
+func (c *trafficConn) Close() error {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.counter.tcpConnections, -1)
+	}
+	return c.Conn.Close()
+}
+
+func (c *trafficConn) Upstream() any {
+	return c.Conn
+}
+
+type trafficPacketWriter struct {
+	N.PacketWriter
+	counter *userCounter
+	closed  uint32
+}
+
+func (w *trafficPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	atomic.AddUint64(&w.counter.download, uint64(buffer.Len()))
+	return w.PacketWriter.WritePacket(buffer, destination)
+}
+
+func (w *trafficPacketWriter) Close() error {
+	if atomic.CompareAndSwapUint32(&w.closed, 0, 1) {
+		atomic.AddInt64(&w.counter.udpSessions, -1)
+	}
+	if closer, isCloser := w.PacketWriter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (w *trafficPacketWriter) Upstream() any {
+	return w.PacketWriter
+}
+
+// countReader and countWriter count bytes copied through the copy paths of a connection.
+// They do not expose their upstream, so copies can not bypass the counter.
+type countReader struct {
+	io.Reader
+	counter *uint64
+}
+
+func (r *countReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	atomic.AddUint64(r.counter, uint64(n))
+	return
+}
+
+type countWriter struct {
+	io.Writer
+	counter *uint64
+}
+
+func (w *countWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	atomic.AddUint64(w.counter, uint64(n))
+	return
+}
@@ -0,0 +1,85 @@
+package shadowsocks_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestTrafficTracker(t *testing.T) {
+	t.Parallel()
+	tracker := shadowsocks.NewTrafficTracker[string]()
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	conn := tracker.TrackConn("user", serverConn)
+	go func() {
+		clientConn.Write([]byte("ping"))
+		io.ReadFull(clientConn, make([]byte, 6))
+	}()
+	_, err := io.ReadFull(conn, make([]byte, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("pong!!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	traffic := tracker.Snapshot(true)["user"]
+	if traffic.Upload != 4 || traffic.Download != 6 || traffic.TCPConnections != 1 {
+		t.Fatal("bad traffic: ", traffic)
+	}
+	conn.Close()
+	traffic = tracker.Snapshot(false)["user"]
+	if traffic.Upload != 0 || traffic.Download != 0 || traffic.TCPConnections != 0 {
+		t.Fatal("bad traffic after reset: ", traffic)
+	}
+}
+
+func TestTrackedConnCopy(t *testing.T) {
+	t.Parallel()
+	tracker := shadowsocks.NewTrafficTracker[string]()
+	registry := shadowsocks.NewRegistry()
+	inner := &copyConn{}
+	conn := registry.TrackConn(tracker.TrackConn("user", inner), M.Metadata{}, "user")
+
+	var output bytes.Buffer
+	_, err := bufio.Copy(&output, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bufio.Copy(conn, io.LimitReader(strings.NewReader("pong!!"), 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inner.writeTo || !inner.readFrom {
+		t.Fatal("copy path of the connection not used")
+	}
+	traffic := tracker.Load("user")
+	connection := registry.Connections()[0]
+	if traffic.Upload != 4 || traffic.Download != 6 || connection.Upload != 4 || connection.Download != 6 {
+		t.Fatal("bad traffic: ", traffic.Upload, "/", traffic.Download, ", registry: ", connection.Upload, "/", connection.Download)
+	}
+}
+
+// copyConn implements io.WriterTo and io.ReaderFrom only.
+type copyConn struct {
+	net.Conn
+	writeTo  bool
+	readFrom bool
+}
+
+func (c *copyConn) WriteTo(w io.Writer) (n int64, err error) {
+	c.writeTo = true
+	return io.Copy(w, strings.NewReader("ping"))
+}
+
+func (c *copyConn) ReadFrom(r io.Reader) (n int64, err error) {
+	c.readFrom = true
+	return io.Copy(io.Discard, r)
+}
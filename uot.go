@@ -0,0 +1,26 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/uot"
+)
+
+// DialUoTPacketConn opens a UDP-over-TCP stream with method on conn, packets are framed
+// with their destination and relayed to real UDP sockets by the server.
+func DialUoTPacketConn(method Method, conn net.Conn) N.NetPacketConn {
+	return uot.NewClientConn(method.DialEarlyConn(conn, M.Socksaddr{Fqdn: uot.UOTMagicAddress}))
+}
+
+// HandleConnection passes a server connection to handler, unwrapping UDP-over-TCP streams
+// into packet connections. Mux sessions are passed as is, see HandleMuxConnection.
+func HandleConnection(ctx context.Context, handler Handler, conn net.Conn, metadata M.Metadata) error {
+	if metadata.Destination.Fqdn == uot.UOTMagicAddress {
+		metadata.Destination = M.Socksaddr{}
+		return handler.NewPacketConnection(ctx, uot.NewClientConn(conn), metadata)
+	}
+	return handler.NewConnection(ctx, conn, metadata)
+}
@@ -0,0 +1,66 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestUoT(t *testing.T) {
+	t.Parallel()
+	handler := &uotHandler{t: t, done: make(chan struct{})}
+	service := shadowsocks.NewNoneService(500, handler)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+
+	packetConn := shadowsocks.DialUoTPacketConn(shadowsocks.NewNone(), clientConn)
+	_, err := packetConn.WriteTo([]byte("ping"), M.ParseSocksaddr("1.1.1.1:53").UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 16)
+	n, addr, err := packetConn.ReadFrom(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response[:n]) != "pong" || addr.String() != "1.1.1.1:53" {
+		t.Fatal("bad response ", string(response[:n]), " from ", addr)
+	}
+	<-handler.done
+}
+
+type uotHandler struct {
+	t    *testing.T
+	done chan struct{}
+}
+
+func (h *uotHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.t.Error("unexpected tcp connection to ", metadata.Destination)
+	return nil
+}
+
+func (h *uotHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	defer close(h.done)
+	buffer := buf.New()
+	destination, err := conn.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	if string(buffer.Bytes()) != "ping" || destination.String() != "1.1.1.1:53" {
+		h.t.Error("bad packet ", string(buffer.Bytes()), " to ", destination)
+	}
+	buffer.Reset()
+	buffer.WriteString("pong")
+	return conn.WritePacket(buffer, destination)
+}
+
+func (h *uotHandler) NewError(ctx context.Context, err error) {
+	h.t.Error(err)
+}